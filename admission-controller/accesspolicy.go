@@ -0,0 +1,377 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Values of --access-policy, which selects what happens to pods that request
+// secrets that no SecretAccessPolicy allows.
+const (
+	accessIgnore = "ignore"
+	accessWarn   = "warn"
+	accessDeny   = "deny"
+)
+
+// Resources of the SecretAccessPolicy and ClusterSecretAccessPolicy custom
+// resources, defined by the CRDs of the chart.
+var (
+	secretAccessPolicies        = schema.GroupVersionResource{Group: "secrets.k8s.aws", Version: "v1alpha1", Resource: "secretaccesspolicies"}
+	clusterSecretAccessPolicies = schema.GroupVersionResource{Group: "secrets.k8s.aws", Version: "v1alpha1", Resource: "clustersecretaccesspolicies"}
+)
+
+// Environment variables of the fetcher that select the secrets it retrieves.
+const (
+	envSecretArn        = "SECRET_ARN"
+	envSecretArns       = "SECRET_ARNS"
+	envSecretFiles      = "SECRET_FILES"
+	envSecretNamePrefix = "SECRET_NAME_PREFIX"
+	envSecretTagFilters = "SECRET_TAG_FILTERS"
+)
+
+// annotationFieldPath matches the field path of an environment variable taken
+// from an annotation of the pod and captures the annotation key.
+var annotationFieldPath = regexp.MustCompile(`^metadata\.annotations\['(.+)'\]$`)
+
+// secretAccessPolicy lists the secrets that pods may request. A
+// SecretAccessPolicy applies to the pods of its namespace, a
+// ClusterSecretAccessPolicy to the pods of the namespaces matching its
+// namespace selector, all namespaces when it has none. Either is restricted
+// to the pods of the listed service accounts, when there are any.
+type secretAccessPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              struct {
+		NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+		ServiceAccounts   []string              `json:"serviceAccounts,omitempty"`
+		// SecretArns are the ARNs of the allowed secrets, in which *
+		// matches any sequence of characters.
+		SecretArns []string `json:"secretArns"`
+	} `json:"spec"`
+}
+
+// name identifies p in the messages and audit annotations.
+func (p *secretAccessPolicy) name() string {
+	if p.Namespace == "" {
+		return "ClusterSecretAccessPolicy/" + p.Name
+	}
+	return "SecretAccessPolicy/" + p.Namespace + "/" + p.Name
+}
+
+// appliesTo reports whether p applies to the pods of serviceAccount in
+// namespace.
+func (p *secretAccessPolicy) appliesTo(namespace, serviceAccount string) (bool, error) {
+	if len(p.Spec.ServiceAccounts) > 0 && !contains(p.Spec.ServiceAccounts, serviceAccount) {
+		return false, nil
+	}
+	if p.Namespace != "" || p.Spec.NamespaceSelector == nil {
+		return p.Namespace == "" || p.Namespace == namespace, nil
+	}
+	selector, err := metav1.LabelSelectorAsSelector(p.Spec.NamespaceSelector)
+	if err != nil {
+		return false, fmt.Errorf("%s: %v", p.name(), err)
+	}
+	if namespaces == nil {
+		return false, fmt.Errorf("%s: namespaces are not watched", p.name())
+	}
+	ns, err := namespaces.get(namespace)
+	if err != nil {
+		return false, err
+	}
+	return selector.Matches(labels.Set(ns.Labels)), nil
+}
+
+// allows reports whether arn matches one of the secret ARNs of p.
+func (p *secretAccessPolicy) allows(arn string) (bool, error) {
+	for _, pattern := range p.Spec.SecretArns {
+		re, err := arnPattern(pattern)
+		if err != nil {
+			return false, fmt.Errorf("%s: invalid secret ARN %q: %v", p.name(), pattern, err)
+		}
+		if re.MatchString(arn) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// arnPatterns caches the regular expressions of arnPattern by pattern, so
+// that the patterns of the policies are not compiled on every admission.
+var arnPatterns sync.Map
+
+// arnPattern returns the regular expression matching the ARNs that pattern
+// matches.
+func arnPattern(pattern string) (*regexp.Regexp, error) {
+	if re, ok := arnPatterns.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	parts := strings.Split(pattern, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	re, err := regexp.Compile("^" + strings.Join(parts, ".*") + "$")
+	if err != nil {
+		return nil, err
+	}
+	arnPatterns.Store(pattern, re)
+	return re, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// accessPolicyStore caches the SecretAccessPolicies and
+// ClusterSecretAccessPolicies of the cluster.
+type accessPolicyStore struct {
+	namespaced cache.GenericLister
+	cluster    cache.GenericLister
+}
+
+// accessPolicies is nil, and access is not checked, when the policy is
+// ignore.
+var accessPolicies *accessPolicyStore
+
+// forPods returns the policies that apply to the pods of serviceAccount in
+// namespace.
+func (s *accessPolicyStore) forPods(namespace, serviceAccount string) ([]*secretAccessPolicy, error) {
+	namespaced, err := s.namespaced.ByNamespace(namespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	cluster, err := s.cluster.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	var policies []*secretAccessPolicy
+	for _, obj := range append(namespaced, cluster...) {
+		u, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			return nil, fmt.Errorf("unexpected object type %T", obj)
+		}
+		p := &secretAccessPolicy{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, p); err != nil {
+			return nil, fmt.Errorf("%s/%s: %v", u.GetKind(), u.GetName(), err)
+		}
+		applies, err := p.appliesTo(namespace, serviceAccount)
+		if err != nil {
+			return nil, err
+		}
+		if applies {
+			policies = append(policies, p)
+		}
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].name() < policies[j].name() })
+	return policies, nil
+}
+
+// startAccessPolicyInformer fills accessPolicies from informers and waits
+// for their caches to sync.
+func startAccessPolicyInformer(stop <-chan struct{}) error {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return err
+	}
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(client, 10*time.Minute)
+	namespaced := factory.ForResource(secretAccessPolicies)
+	cluster := factory.ForResource(clusterSecretAccessPolicies)
+	factory.Start(stop)
+	if !cache.WaitForCacheSync(stop, namespaced.Informer().HasSynced, cluster.Informer().HasSynced) {
+		return fmt.Errorf("secret access policy cache did not sync")
+	}
+	accessPolicies = &accessPolicyStore{namespaced: namespaced.Lister(), cluster: cluster.Lister()}
+	return nil
+}
+
+// podSecret is a secret that a pod can retrieve, with where it is requested.
+type podSecret struct {
+	source string
+	arn    string
+}
+
+// podSecrets returns the secrets that pod can retrieve: those requested by its
+// annotations, then those selected by the environment of its fetcher
+// containers, whether they were injected or the pod brought its own, so that
+// a pod cannot retrieve other secrets than those checked. It also returns the
+// problems with the fetcher environments whose secrets cannot be known at
+// admission.
+func podSecrets(pod *corev1.Pod) ([]podSecret, []string) {
+	var secrets []podSecret
+	for _, r := range secretRequests(pod.ObjectMeta.Annotations) {
+		secrets = append(secrets, podSecret{source: indexed(annotationSecretArn, r.name), arn: r.arn})
+	}
+	var problems []string
+	for _, containers := range [][]corev1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for _, c := range containers {
+			if !isFetcher(c) {
+				continue
+			}
+			if len(c.EnvFrom) > 0 {
+				problems = append(problems, fmt.Sprintf("container %s: the environment of a fetcher cannot be taken from ConfigMaps or Secrets, its secrets cannot be checked", c.Name))
+			}
+			for _, e := range c.Env {
+				if !selectsSecrets(e.Name) {
+					continue
+				}
+				source := fmt.Sprintf("container %s: %s", c.Name, e.Name)
+				value, ok := envValue(pod, e)
+				if !ok {
+					problems = append(problems, source+": must be set literally or from an annotation of the pod, its secrets cannot be checked")
+					continue
+				}
+				if value == "" {
+					continue
+				}
+				switch e.Name {
+				case envSecretArn:
+					secrets = append(secrets, podSecret{source: source, arn: value})
+				case envSecretArns:
+					for _, arn := range strings.Split(value, ",") {
+						if arn = strings.TrimSpace(arn); arn != "" {
+							secrets = append(secrets, podSecret{source: source, arn: arn})
+						}
+					}
+				case envSecretFiles:
+					files := map[string]string{}
+					if err := json.Unmarshal([]byte(value), &files); err != nil {
+						problems = append(problems, fmt.Sprintf("%s: %v", source, err))
+						continue
+					}
+					var paths []string
+					for p := range files {
+						paths = append(paths, p)
+					}
+					sort.Strings(paths)
+					for _, p := range paths {
+						secrets = append(secrets, podSecret{source: source, arn: files[p]})
+					}
+				default:
+					problems = append(problems, source+": secrets selected by name prefix or tags cannot be checked")
+				}
+			}
+		}
+	}
+	return secrets, problems
+}
+
+// isFetcher reports whether c runs the fetcher: it is an injected container,
+// runs one of the images of the injected containers or has an environment
+// variable that selects secrets.
+func isFetcher(c corev1.Container) bool {
+	if c.Name == initContainerName || c.Name == refreshContainerName {
+		return true
+	}
+	if c.Image != "" && (c.Image == sidecarImage || imageAllowed(c.Image)) {
+		return true
+	}
+	for _, e := range c.Env {
+		if selectsSecrets(e.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+func selectsSecrets(name string) bool {
+	switch name {
+	case envSecretArn, envSecretArns, envSecretFiles, envSecretNamePrefix, envSecretTagFilters:
+		return true
+	}
+	return false
+}
+
+// envValue returns the value of e in pod, if it is set literally or from an
+// annotation of pod.
+func envValue(pod *corev1.Pod, e corev1.EnvVar) (string, bool) {
+	if e.ValueFrom == nil {
+		return e.Value, true
+	}
+	if e.ValueFrom.FieldRef == nil {
+		return "", false
+	}
+	m := annotationFieldPath.FindStringSubmatch(e.ValueFrom.FieldRef.FieldPath)
+	if m == nil {
+		return "", false
+	}
+	return pod.ObjectMeta.Annotations[m[1]], true
+}
+
+// checkAccess looks up the policies allowing the secrets that pod, in
+// namespace, can retrieve, as returned by podSecrets. It returns the audit
+// annotations recording them, and a problem for each secret that none allows
+// or that cannot be checked. The problems are warnings or denials according
+// to --access-policy.
+func checkAccess(pod *corev1.Pod, namespace string) (audit map[string]string, problems []string) {
+	if accessPolicies == nil {
+		return nil, nil
+	}
+	secrets, problems := podSecrets(pod)
+	if len(secrets) == 0 && len(problems) == 0 {
+		return nil, nil
+	}
+	serviceAccount := pod.Spec.ServiceAccountName
+	if serviceAccount == "" {
+		serviceAccount = "default"
+	}
+	policies, err := accessPolicies.forPods(namespace, serviceAccount)
+	if err != nil {
+		log.error("unable to look up secret access policies", fields{fieldNamespace: namespace, "service_account": serviceAccount, fieldError: err})
+		return nil, []string{fmt.Sprintf("unable to check the secret access policies: %v", err)}
+	}
+	var allowedBy []string
+	checked := map[string]bool{}
+	for _, s := range secrets {
+		if checked[s.arn] {
+			continue
+		}
+		checked[s.arn] = true
+		allowed := false
+		for _, p := range policies {
+			ok, err := p.allows(s.arn)
+			if err != nil {
+				log.error("invalid secret access policy", fields{fieldNamespace: namespace, "service_account": serviceAccount, fieldError: err})
+				return nil, []string{fmt.Sprintf("unable to check the secret access policies: %v", err)}
+			}
+			if ok {
+				allowed = true
+				if !contains(allowedBy, p.name()) {
+					allowedBy = append(allowedBy, p.name())
+				}
+			}
+		}
+		if !allowed {
+			problems = append(problems, fmt.Sprintf("%s: %s is not allowed for service account %s by any SecretAccessPolicy or ClusterSecretAccessPolicy",
+				s.source, s.arn, serviceAccount))
+		}
+	}
+	sort.Strings(allowedBy)
+	if len(allowedBy) > 0 {
+		audit = map[string]string{"access-policies": strings.Join(allowedBy, ",")}
+	}
+	return audit, problems
+}
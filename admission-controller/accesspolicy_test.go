@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/yaml"
+)
+
+const testAccessPolicies = `
+apiVersion: secrets.k8s.aws/v1alpha1
+kind: SecretAccessPolicy
+metadata:
+  name: payments
+  namespace: default
+spec:
+  serviceAccounts: [payments]
+  secretArns:
+  - arn:aws:secretsmanager:us-east-1:123456789012:secret:payments/*
+---
+apiVersion: secrets.k8s.aws/v1alpha1
+kind: SecretAccessPolicy
+metadata:
+  name: other
+  namespace: other
+spec:
+  secretArns:
+  - "*"
+---
+apiVersion: secrets.k8s.aws/v1alpha1
+kind: ClusterSecretAccessPolicy
+metadata:
+  name: shared
+spec:
+  namespaceSelector:
+    matchLabels:
+      team: shop
+  secretArns:
+  - arn:aws:secretsmanager:*:123456789012:secret:shared/*
+`
+
+func withAccessPolicies(t *testing.T, policy string) {
+	t.Helper()
+	namespaced := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	cluster := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, doc := range strings.Split(testAccessPolicies, "---") {
+		u := &unstructured.Unstructured{}
+		if err := yaml.Unmarshal([]byte(doc), &u.Object); err != nil {
+			t.Fatal(err)
+		}
+		if u.GetNamespace() == "" {
+			cluster.Add(u)
+		} else {
+			namespaced.Add(u)
+		}
+	}
+	accessPolicies = &accessPolicyStore{
+		namespaced: cache.NewGenericLister(namespaced, secretAccessPolicies.GroupResource()),
+		cluster:    cache.NewGenericLister(cluster, clusterSecretAccessPolicies.GroupResource()),
+	}
+	namespaceIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	namespaceIndexer.Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default", Labels: map[string]string{"team": "shop"}}})
+	namespaceIndexer.Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "other"}})
+	namespaces = &namespaceCache{lister: corelisters.NewNamespaceLister(namespaceIndexer), client: fake.NewSimpleClientset()}
+	accessPolicy = policy
+	t.Cleanup(func() { accessPolicies, namespaces, accessPolicy = nil, nil, accessIgnore })
+}
+
+func TestValidatePodsAccessPolicy(t *testing.T) {
+	withAccessPolicies(t, accessDeny)
+	const (
+		paymentsArn = "arn:aws:secretsmanager:us-east-1:123456789012:secret:payments/db-AbCdEf"
+		sharedArn   = "arn:aws:secretsmanager:us-east-1:123456789012:secret:shared/api-AbCdEf"
+	)
+	podWith := func(namespace, serviceAccount string, arns ...string) *corev1.Pod {
+		annotations := map[string]string{}
+		for i, arn := range arns {
+			annotations[indexed(annotationSecretArn, []string{"", "second"}[i])] = arn
+		}
+		pod := secretPod(annotations)
+		pod.Namespace = namespace
+		pod.Spec.ServiceAccountName = serviceAccount
+		return pod
+	}
+
+	testCases := []struct {
+		name    string
+		pod     *corev1.Pod
+		allowed bool
+		audit   string
+	}{
+		{"namespace policy", podWith("default", "payments", paymentsArn), true,
+			"SecretAccessPolicy/default/payments"},
+		{"several policies", podWith("default", "payments", paymentsArn, sharedArn), true,
+			"ClusterSecretAccessPolicy/shared,SecretAccessPolicy/default/payments"},
+		{"other service account", podWith("default", "web", paymentsArn), false, ""},
+		{"cluster policy", podWith("default", "web", sharedArn), true,
+			"ClusterSecretAccessPolicy/shared"},
+		{"namespace not selected", podWith("other", "web", sharedArn), true,
+			"SecretAccessPolicy/other/other"},
+		{"no policy", podWith("default", "", testArn), false, ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := validatePods(podReview(t, tc.pod))
+			if resp.Allowed != tc.allowed {
+				t.Fatalf("allowed = %v, want %v: %#v", resp.Allowed, tc.allowed, resp.Result)
+			}
+			if got := resp.AuditAnnotations["access-policies"]; got != tc.audit {
+				t.Errorf("access-policies audit annotation = %q, want %q", got, tc.audit)
+			}
+			if !tc.allowed && !strings.Contains(resp.Result.Message, "is not allowed for service account") {
+				t.Errorf("unexpected message %q", resp.Result.Message)
+			}
+		})
+	}
+
+	accessPolicy = accessWarn
+	resp := validatePods(podReview(t, podWith("default", "web", paymentsArn)))
+	want := []string{"secrets.k8s.aws/secret-arn: " + paymentsArn + " is not allowed for service account web by any SecretAccessPolicy or ClusterSecretAccessPolicy"}
+	if !resp.Allowed || !reflect.DeepEqual(resp.Warnings[len(resp.Warnings)-1:], want) {
+		t.Errorf("expected a warning, got %#v", resp)
+	}
+}
+
+// TestValidatePodsAccessPolicyFetcherEnv checks that the secrets selected by
+// the environment of fetcher containers are checked too, so that a pod cannot
+// retrieve secrets that its annotations do not request.
+func TestValidatePodsAccessPolicyFetcherEnv(t *testing.T) {
+	withAccessPolicies(t, accessDeny)
+	sidecarImage = "test-image"
+	const (
+		paymentsArn = "arn:aws:secretsmanager:us-east-1:123456789012:secret:payments/db-AbCdEf"
+		sharedArn   = "arn:aws:secretsmanager:us-east-1:123456789012:secret:shared/api-AbCdEf"
+	)
+	podWith := func(annotations map[string]string, fetcher corev1.Container) *corev1.Pod {
+		pod := secretPod(annotations, fetcher)
+		pod.Spec.ServiceAccountName = "web"
+		return pod
+	}
+	env := func(name, value string) []corev1.EnvVar {
+		return []corev1.EnvVar{{Name: name, Value: value}}
+	}
+
+	testCases := []struct {
+		name    string
+		pod     *corev1.Pod
+		problem string
+	}{
+		{"own fetcher", podWith(nil, corev1.Container{Name: "fetch", Image: "fetcher", Env: env("SECRET_ARN", paymentsArn)}),
+			"container fetch: SECRET_ARN: " + paymentsArn + " is not allowed"},
+		{"opted out", podWith(map[string]string{annotationInject: "false"}, corev1.Container{Name: "fetch", Image: "fetcher", Env: env("SECRET_ARNS", sharedArn+","+paymentsArn)}),
+			"container fetch: SECRET_ARNS: " + paymentsArn + " is not allowed"},
+		{"injected marker", podWith(map[string]string{annotationSecretArn: sharedArn, annotationInjected: "true"}, corev1.Container{Name: initContainerName, Image: "fetcher", Env: env("SECRET_FILES", `{"a":"`+sharedArn+`","b":"`+paymentsArn+`"}`)}),
+			"container secrets-init-container: SECRET_FILES: " + paymentsArn + " is not allowed"},
+		{"annotation not requested", podWith(map[string]string{"team/secret": paymentsArn}, corev1.Container{Name: "fetch", Image: "fetcher", Env: []corev1.EnvVar{
+			{Name: "SECRET_ARN", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.annotations['team/secret']"}}},
+		}}), "container fetch: SECRET_ARN: " + paymentsArn + " is not allowed"},
+		{"environment from a ConfigMap", podWith(nil, corev1.Container{Name: "fetch", Image: "test-image", EnvFrom: []corev1.EnvFromSource{{ConfigMapRef: &corev1.ConfigMapEnvSource{}}}}),
+			"container fetch: the environment of a fetcher cannot be taken from ConfigMaps or Secrets"},
+		{"name prefix", podWith(nil, corev1.Container{Name: "fetch", Image: "fetcher", Env: env("SECRET_NAME_PREFIX", "payments/")}),
+			"container fetch: SECRET_NAME_PREFIX: secrets selected by name prefix or tags cannot be checked"},
+		{"allowed", podWith(nil, corev1.Container{Name: "fetch", Image: "fetcher", Env: env("SECRET_ARN", sharedArn)}), ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := validatePods(podReview(t, tc.pod))
+			if tc.problem == "" {
+				if !resp.Allowed {
+					t.Errorf("pod was rejected: %s", resp.Result.Message)
+				}
+				return
+			}
+			if resp.Allowed || !strings.Contains(resp.Result.Message, tc.problem) {
+				t.Errorf("expected the pod to be rejected with %q, got %#v", tc.problem, resp)
+			}
+		})
+	}
+
+	// The environment of the injected fetcher selects the secrets of the
+	// annotations, which are reported once.
+	pod := secretPod(map[string]string{annotationSecretArn: sharedArn, annotationSecretArn + ".db": paymentsArn})
+	pod.Spec.ServiceAccountName = "web"
+	resp := validatePods(podReview(t, admit(t, mutatePods, pod)))
+	if resp.Allowed || strings.Count(resp.Result.Message, paymentsArn) != 1 {
+		t.Errorf("expected the pod to be rejected once for %s, got %#v", paymentsArn, resp.Result)
+	}
+}
+
+// TestValidatePodsAccessPolicyUpdate checks that running pods can be updated
+// after the policies no longer allow their secrets, unless the update changes
+// the secrets.
+func TestValidatePodsAccessPolicyUpdate(t *testing.T) {
+	withAccessPolicies(t, accessDeny)
+	const paymentsArn = "arn:aws:secretsmanager:us-east-1:123456789012:secret:payments/db-AbCdEf"
+	old := secretPod(map[string]string{annotationSecretArn: paymentsArn}, corev1.Container{Name: "fetch", Image: "fetcher", Env: []corev1.EnvVar{{Name: "SECRET_ARN", Value: paymentsArn}}})
+	old.Spec.ServiceAccountName = "web"
+	old.Finalizers = []string{"example.com/cleanup"}
+	update := func(pod *corev1.Pod) v1.AdmissionReview {
+		ar := podReview(t, pod)
+		raw, err := json.Marshal(old)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ar.Request.Operation = v1.Update
+		ar.Request.OldObject = runtime.RawExtension{Raw: raw}
+		return ar
+	}
+
+	pod := old.DeepCopy()
+	pod.Finalizers = nil
+	pod.Annotations["example.com/owner"] = "team"
+	if resp := validatePods(update(pod)); !resp.Allowed {
+		t.Errorf("finalizer removal was rejected: %s", resp.Result.Message)
+	}
+
+	pod = old.DeepCopy()
+	pod.Annotations[annotationSecretArn+".api"] = paymentsArn
+	if resp := validatePods(update(pod)); resp.Allowed {
+		t.Error("expected an update of the secret annotations to be checked")
+	}
+}
+
+func TestArnPattern(t *testing.T) {
+	for pattern, matches := range map[string]map[string]bool{
+		"arn:aws:secretsmanager:us-east-1:123456789012:secret:app/*": {
+			"arn:aws:secretsmanager:us-east-1:123456789012:secret:app/db-AbCdEf": true,
+			"arn:aws:secretsmanager:us-east-1:123456789012:secret:other-AbCdEf":  false,
+			"arn:aws:secretsmanager:us-east-1:123456789012:secret:app":           false,
+		},
+		"arn:aws:secretsmanager:us-east-1:123456789012:secret:db-??????": {
+			"arn:aws:secretsmanager:us-east-1:123456789012:secret:db-AbCdEf": false,
+			"arn:aws:secretsmanager:us-east-1:123456789012:secret:db-??????": true,
+		},
+	} {
+		for arn, want := range matches {
+			re, err := arnPattern(pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := re.MatchString(arn); got != want {
+				t.Errorf("%s matches %s = %v, want %v", pattern, arn, got, want)
+			}
+		}
+	}
+}
+
+func TestInvalidArnPattern(t *testing.T) {
+	if _, err := arnPattern("arn:aws:secretsmanager:*:\xff"); err == nil {
+		t.Fatal("expected an error for a pattern that is not valid UTF-8")
+	}
+	p := &secretAccessPolicy{}
+	p.Kind, p.Name = "ClusterSecretAccessPolicy", "broken"
+	p.Spec.SecretArns = []string{"arn:aws:secretsmanager:*:\xff"}
+	if _, err := p.allows(testArn); err == nil || !strings.Contains(err.Error(), "ClusterSecretAccessPolicy/broken") {
+		t.Errorf("allows error = %v, want an error naming the policy", err)
+	}
+}
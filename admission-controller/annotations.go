@@ -0,0 +1,119 @@
+package main
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// secretRequest is a secret requested through the annotations of a pod.
+//
+// The unindexed secrets.k8s.aws/secret-arn, mount-path and secret-filename
+// annotations request a secret with an empty name, which is written to the
+// root of the secret volume and mounted as a whole. Indexed annotations such
+// as secrets.k8s.aws/secret-arn.db request a secret named db, which is
+// written to the db directory of the volume and mounted on its own.
+type secretRequest struct {
+	name      string
+	arn       string
+	mountPath string
+	filename  string
+}
+
+// secretRequests returns the secrets requested by annotations, the unindexed
+// secret first and the others ordered by name. Indexed annotations whose name
+// is not a valid DNS label are ignored.
+func secretRequests(annotations map[string]string) []secretRequest {
+	var requests []secretRequest
+	for key, arn := range annotations {
+		name, ok := annotationIndex(key, annotationSecretArn)
+		if !ok {
+			continue
+		}
+		if name != "" && len(validation.IsDNS1123Label(name)) > 0 {
+			log.info("ignoring secret with an invalid name", fields{"annotation": key})
+			continue
+		}
+		requests = append(requests, secretRequest{
+			name:      name,
+			arn:       arn,
+			mountPath: annotations[indexed(annotationMountPath, name)],
+			filename:  annotations[indexed(annotationSecretFilename, name)],
+		})
+	}
+	sort.Slice(requests, func(i, j int) bool { return requests[i].name < requests[j].name })
+	return requests
+}
+
+// annotationIndex reports whether key is the annotation base, either
+// unindexed or indexed, and returns the index.
+func annotationIndex(key, base string) (string, bool) {
+	if key == base {
+		return "", true
+	}
+	if strings.HasPrefix(key, base+".") {
+		return strings.TrimPrefix(key, base+"."), true
+	}
+	return "", false
+}
+
+// indexed returns the annotation base for the secret called name.
+func indexed(base, name string) string {
+	if name == "" {
+		return base
+	}
+	return base + "." + name
+}
+
+// volumePath returns the file, relative to the root of the secret volume,
+// that the secret is written to.
+func (r secretRequest) volumePath() string {
+	filename := r.filename
+	if filename == "" {
+		filename = "secret"
+	}
+	return path.Join("/", r.name, filename)
+}
+
+// containerMountPath returns where the secret is mounted in a container whose
+// secrets are mounted under base, or under the default mount path when base
+// is empty. A mount path annotation for the secret takes precedence.
+func (r secretRequest) containerMountPath(base string) string {
+	if r.mountPath != "" {
+		return r.mountPath
+	}
+	if base == "" {
+		base = defaultMountPath
+	}
+	if r.name == "" {
+		return base
+	}
+	return path.Join(base, r.name)
+}
+
+// mountTargets parses the containers annotation, a comma separated list of
+// container names, each optionally followed by a colon and the path secrets
+// are mounted under in that container, e.g. "app,worker:/etc/secrets". It
+// returns the mount path of each listed container, empty for the default, and
+// whether the annotation was set.
+func mountTargets(annotations map[string]string) (map[string]string, bool) {
+	value, ok := annotations[annotationContainers]
+	if !ok {
+		return nil, false
+	}
+	targets := map[string]string{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, mountPath := entry, ""
+		if i := strings.Index(entry, ":"); i >= 0 {
+			name, mountPath = strings.TrimSpace(entry[:i]), strings.TrimSpace(entry[i+1:])
+		}
+		targets[name] = mountPath
+	}
+	return targets, true
+}
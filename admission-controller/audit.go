@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Keys of the audit annotations set on the admission of pods that secrets are
+// injected into. The API server prefixes them with the name of the webhook.
+const (
+	auditSecretArns = "secret-arns"
+	auditMountPaths = "mount-paths"
+	auditMode       = "mode"
+	auditVersion    = "injector-version"
+	auditDefaults   = "namespace-defaults"
+)
+
+// injectionAudit returns the audit annotations describing what was injected
+// into pod to give mutated, with the namespace defaults applied.
+func injectionAudit(pod, mutated *corev1.Pod, defaults []string) map[string]string {
+	mode := mutated.ObjectMeta.Annotations[annotationMode]
+	switch {
+	case injectionTemplate != nil:
+		mode = "template"
+	case mode != modeSidecar:
+		mode = modeInit
+	case nativeSidecars:
+		mode = "native-sidecar"
+	}
+	audit := map[string]string{
+		auditSecretArns: secretArns(pod),
+		auditMode:       mode,
+		auditVersion:    version,
+	}
+	if mounts := addedMounts(pod, mutated); len(mounts) > 0 {
+		audit[auditMountPaths] = strings.Join(mounts, ",")
+	}
+	if len(defaults) > 0 {
+		audit[auditDefaults] = strings.Join(defaults, ",")
+	}
+	return audit
+}
+
+// addedMounts returns the volume mounts added to the containers of pod, as
+// sorted container:path pairs. The containers that were injected are left
+// out.
+func addedMounts(pod, mutated *corev1.Pod) []string {
+	original := map[string]map[string]bool{}
+	for _, containers := range [][]corev1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for _, c := range containers {
+			original[c.Name] = map[string]bool{}
+			for _, m := range c.VolumeMounts {
+				original[c.Name][m.MountPath] = true
+			}
+		}
+	}
+	var added []string
+	for _, containers := range [][]corev1.Container{mutated.Spec.InitContainers, mutated.Spec.Containers} {
+		for _, c := range containers {
+			mounts, ok := original[c.Name]
+			if !ok {
+				continue
+			}
+			for _, m := range c.VolumeMounts {
+				if !mounts[m.MountPath] {
+					added = append(added, c.Name+":"+m.MountPath)
+				}
+			}
+		}
+	}
+	sort.Strings(added)
+	return added
+}
+
+// annotationWarnings returns a warning for each secrets.k8s.aws/ annotation
+// of pod that the injection ignores, so that users see it in the output of
+// kubectl rather than wondering why it had no effect.
+func annotationWarnings(pod *corev1.Pod) []string {
+	annotations := pod.ObjectMeta.Annotations
+	warnings := unusedAnnotations(annotations, secretRequests(annotations))
+
+	mode, ok := annotations[annotationMode]
+	if ok && mode != modeInit && mode != modeSidecar {
+		warnings = append(warnings, fmt.Sprintf("%s: %q is not %s or %s, ignored", annotationMode, mode, modeInit, modeSidecar))
+	}
+	for _, key := range []string{annotationRefreshInterval, annotationHealthPort} {
+		if _, ok := annotations[key]; ok && mode != modeSidecar {
+			warnings = append(warnings, fmt.Sprintf("%s: ignored unless %s is %s", key, annotationMode, modeSidecar))
+		}
+	}
+	for _, key := range []string{annotationCPURequest, annotationMemoryRequest, annotationCPULimit, annotationMemoryLimit} {
+		if v, ok := annotations[key]; ok {
+			if _, err := parseQuantity(v); err != nil {
+				warnings = append(warnings, fmt.Sprintf("%s: %q is not a quantity, ignored", key, v))
+			}
+		}
+	}
+	if v, ok := annotations[annotationImagePullPolicy]; ok && !validPullPolicy(v) {
+		warnings = append(warnings, fmt.Sprintf("%s: %q is not Always, IfNotPresent or Never, ignored", annotationImagePullPolicy, v))
+	}
+	if v, ok := annotations[annotationImage]; ok && !imageAllowed(v) {
+		warnings = append(warnings, fmt.Sprintf("%s: %q is not one of the images allowed by --allowed-images, ignored", annotationImage, v))
+	}
+
+	targets, _ := mountTargets(annotations)
+	var missing []string
+	for name := range targets {
+		if !hasContainer(pod.Spec.Containers, name) && !hasContainer(pod.Spec.InitContainers, name) {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	for _, name := range missing {
+		warnings = append(warnings, fmt.Sprintf("%s: the pod has no container %s, ignored", annotationContainers, name))
+	}
+	return warnings
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestMutatePodsAuditAnnotations(t *testing.T) {
+	sidecarImage = "test-image"
+	resp := mutatePods(podReview(t, secretPod(map[string]string{
+		annotationSecretArn:         testArn,
+		annotationSecretArn + ".db": testArn,
+		annotationMountPath + ".db": "/var/db",
+		annotationContainers:        "app",
+	})))
+	want := map[string]string{
+		auditSecretArns: testArn + "," + testArn,
+		auditMountPaths: "app:/tmp/,app:/var/db",
+		auditMode:       modeInit,
+		auditVersion:    version,
+	}
+	if !reflect.DeepEqual(resp.AuditAnnotations, want) {
+		t.Errorf("got audit annotations %v, want %v", resp.AuditAnnotations, want)
+	}
+	if len(resp.Warnings) > 0 {
+		t.Errorf("unexpected warnings %q", resp.Warnings)
+	}
+
+	// Pods that are not patched have none.
+	if resp := mutatePods(podReview(t, secretPod(nil))); resp.AuditAnnotations != nil {
+		t.Errorf("unexpected audit annotations %v", resp.AuditAnnotations)
+	}
+}
+
+func TestMutatePodsWarnings(t *testing.T) {
+	sidecarImage = "test-image"
+	resp := mutatePods(podReview(t, secretPod(map[string]string{
+		annotationSecretArn:         testArn,
+		"secrets.k8s.aws/mountpath": "/var",
+		annotationRefreshInterval:   "1m",
+		annotationMemoryLimit:       "lots",
+		annotationContainers:        "app,worker",
+	}, corev1.Container{Name: "migrate"})))
+	if !resp.Allowed || resp.Patch == nil {
+		t.Fatalf("expected the pod to be patched, got %#v", resp)
+	}
+	want := []string{
+		"secrets.k8s.aws/mountpath: unknown annotation",
+		"secrets.k8s.aws/refresh-interval: ignored unless secrets.k8s.aws/mode is sidecar",
+		`secrets.k8s.aws/memory-limit: "lots" is not a quantity, ignored`,
+		"secrets.k8s.aws/containers: the pod has no container worker, ignored",
+	}
+	if !reflect.DeepEqual(resp.Warnings, want) {
+		t.Errorf("got warnings %q, want %q", resp.Warnings, want)
+	}
+	if got := convertAdmissionResponseToV1beta1(resp).Warnings; !reflect.DeepEqual(got, want) {
+		t.Errorf("v1beta1 response lost the warnings: %q", got)
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"reflect"
+	"sort"
+	"time"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	caValidity         = 10 * 365 * 24 * time.Hour
+	caRenewBefore      = 365 * 24 * time.Hour
+	servingValidity    = 365 * 24 * time.Hour
+	servingRenewBefore = 90 * 24 * time.Hour
+
+	// bootstrapInterval is how often the leader checks the certificates.
+	bootstrapInterval = time.Minute
+
+	// Keys of the certificate Secret besides tls.crt and tls.key. ca.crt is
+	// the bundle trusted by the API server: the current CA first, followed
+	// by the previous CAs that have not expired yet.
+	secretCACert = "ca.crt"
+	secretCAKey  = "ca.key"
+)
+
+// bootstrapper generates the CA and serving certificate of the webhook,
+// stores them in a Secret and keeps the caBundle of the webhook
+// configurations up to date. Every replica serves the certificate in the
+// Secret; only the leader, elected with a Lease named after the Secret,
+// creates and rotates it.
+type bootstrapper struct {
+	client      kubernetes.Interface
+	namespace   string
+	secretName  string
+	serviceName string
+	webhookName string
+	now         func() time.Time
+}
+
+func newBootstrapper(namespace, secretName, serviceName, webhookName string) (*bootstrapper, error) {
+	if namespace == "" {
+		return nil, fmt.Errorf("--namespace or POD_NAMESPACE must be set to bootstrap certificates")
+	}
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &bootstrapper{
+		client:      client,
+		namespace:   namespace,
+		secretName:  secretName,
+		serviceName: serviceName,
+		webhookName: webhookName,
+		now:         time.Now,
+	}, nil
+}
+
+// dnsNames are the names the API server may use to reach the service.
+func (b *bootstrapper) dnsNames() []string {
+	svc := b.serviceName
+	return []string{svc, svc + "." + b.namespace, svc + "." + b.namespace + ".svc", svc + "." + b.namespace + ".svc.cluster.local"}
+}
+
+// start loads the certificate Secret into store whenever it changes and runs
+// the leader election in the background until ctx is done.
+func (b *bootstrapper) start(ctx context.Context, store *certStore) error {
+	factory := informers.NewSharedInformerFactoryWithOptions(b.client, 10*time.Minute,
+		informers.WithNamespace(b.namespace),
+		informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+			o.FieldSelector = "metadata.name=" + b.secretName
+		}))
+	informer := factory.Core().V1().Secrets().Informer()
+	if _, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { b.load(store, obj) },
+		UpdateFunc: func(_, obj interface{}) { b.load(store, obj) },
+	}); err != nil {
+		return err
+	}
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return fmt.Errorf("certificate secret cache did not sync")
+	}
+
+	identity, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta:  metav1.ObjectMeta{Name: b.secretName, Namespace: b.namespace},
+			Client:     b.client.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+		},
+		LeaseDuration:   15 * time.Second,
+		RenewDeadline:   10 * time.Second,
+		RetryPeriod:     2 * time.Second,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: b.lead,
+			OnStoppedLeading: func() { log.info("stopped managing webhook certificates", fields{"identity": identity}) },
+		},
+	})
+	if err != nil {
+		return err
+	}
+	go func() {
+		// Run returns when the leadership is lost; stand for election again.
+		for ctx.Err() == nil {
+			elector.Run(ctx)
+		}
+	}()
+	return nil
+}
+
+// load sets the serving certificate of the Secret obj in store.
+func (b *bootstrapper) load(store *certStore, obj interface{}) {
+	secret, ok := obj.(*corev1.Secret)
+	if !ok || len(secret.Data[corev1.TLSCertKey]) == 0 {
+		return
+	}
+	if err := store.set(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey]); err != nil {
+		log.error("unable to load webhook certificate from secret, keeping the previous one", fields{"secret": b.secretName, fieldError: err})
+	}
+}
+
+// lead reconciles the certificates every bootstrapInterval while this
+// replica is the leader.
+func (b *bootstrapper) lead(ctx context.Context) {
+	log.info("managing webhook certificates", fields{"secret": b.secretName})
+	ticker := time.NewTicker(bootstrapInterval)
+	defer ticker.Stop()
+	for {
+		if err := b.reconcile(ctx); err != nil {
+			log.error("unable to reconcile webhook certificates", fields{"secret": b.secretName, fieldError: err})
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reconcile creates or rotates the certificates in the Secret and makes the
+// webhook configurations trust them. The caBundle is patched before the
+// Secret is written, so that the API server trusts a new CA before any
+// replica serves a certificate signed by it.
+func (b *bootstrapper) reconcile(ctx context.Context) error {
+	secrets := b.client.CoreV1().Secrets(b.namespace)
+	secret, err := secrets.Get(ctx, b.secretName, metav1.GetOptions{})
+	create := errors.IsNotFound(err)
+	if create {
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: b.secretName, Namespace: b.namespace},
+			Type:       corev1.SecretTypeTLS,
+		}
+	} else if err != nil {
+		return err
+	}
+	data := map[string][]byte{}
+	for k, v := range secret.Data {
+		data[k] = v
+	}
+	ca, caKey, err := b.ensureCA(data)
+	if err != nil {
+		return err
+	}
+	if err := b.ensureServing(data, ca, caKey); err != nil {
+		return err
+	}
+	if err := b.patchCABundle(ctx, data[secretCACert]); err != nil {
+		return err
+	}
+	if reflect.DeepEqual(data, secret.Data) {
+		return nil
+	}
+	secret.Data = data
+	if create {
+		_, err = secrets.Create(ctx, secret, metav1.CreateOptions{})
+	} else {
+		_, err = secrets.Update(ctx, secret, metav1.UpdateOptions{})
+	}
+	return err
+}
+
+// ensureCA returns the current CA of data, after generating a new one when
+// it is missing, invalid or about to expire.
+func (b *bootstrapper) ensureCA(data map[string][]byte) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	now := b.now()
+	bundle := parseCertificates(data[secretCACert])
+	if len(bundle) > 0 && now.Add(caRenewBefore).Before(bundle[0].NotAfter) {
+		if key, err := parseKey(data[secretCAKey]); err == nil && key.PublicKey.Equal(bundle[0].PublicKey) {
+			return bundle[0], key, nil
+		}
+	}
+
+	tmpl := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: b.serviceName + "-ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	ca, key, certPEM, keyPEM, err := newCertificate(tmpl, nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Keep trusting the previous CAs until they expire, so that replicas
+	// still serving a certificate signed by them keep working.
+	for _, old := range bundle {
+		if now.Before(old.NotAfter) {
+			certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: old.Raw})...)
+		}
+	}
+	data[secretCACert], data[secretCAKey] = certPEM, keyPEM
+	log.info("generated webhook CA", fields{"not_after": ca.NotAfter.UTC().Format(time.RFC3339)})
+	return ca, key, nil
+}
+
+// ensureServing issues a new serving certificate in data when it is missing,
+// invalid, about to expire, not signed by ca or not valid for the service.
+func (b *bootstrapper) ensureServing(data map[string][]byte, ca *x509.Certificate, caKey *ecdsa.PrivateKey) error {
+	now := b.now()
+	names := b.dnsNames()
+	if cert, err := tls.X509KeyPair(data[corev1.TLSCertKey], data[corev1.TLSPrivateKeyKey]); err == nil {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err == nil && now.Add(servingRenewBefore).Before(leaf.NotAfter) && leaf.CheckSignatureFrom(ca) == nil && sameNames(leaf.DNSNames, names) {
+			return nil
+		}
+	}
+
+	tmpl := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: names[2]},
+		DNSNames:    names,
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(servingValidity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	leaf, _, certPEM, keyPEM, err := newCertificate(tmpl, ca, caKey)
+	if err != nil {
+		return err
+	}
+	data[corev1.TLSCertKey], data[corev1.TLSPrivateKeyKey] = certPEM, keyPEM
+	log.info("issued webhook serving certificate", fields{"not_after": leaf.NotAfter.UTC().Format(time.RFC3339)})
+	return nil
+}
+
+// patchCABundle sets bundle as the caBundle of the webhooks of the mutating
+// and validating configurations that call this service.
+func (b *bootstrapper) patchCABundle(ctx context.Context, bundle []byte) error {
+	admission := b.client.AdmissionregistrationV1()
+	mutating, err := admission.MutatingWebhookConfigurations().Get(ctx, b.webhookName, metav1.GetOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	if err == nil {
+		changed := false
+		for i := range mutating.Webhooks {
+			changed = b.setCABundle(&mutating.Webhooks[i].ClientConfig.CABundle, mutating.Webhooks[i].ClientConfig.Service, bundle) || changed
+		}
+		if changed {
+			if _, err := admission.MutatingWebhookConfigurations().Update(ctx, mutating, metav1.UpdateOptions{}); err != nil {
+				return err
+			}
+			log.info("patched caBundle", fields{"mutating_webhook_configuration": b.webhookName})
+		}
+	}
+
+	validating, err := admission.ValidatingWebhookConfigurations().Get(ctx, b.webhookName, metav1.GetOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	if err == nil {
+		changed := false
+		for i := range validating.Webhooks {
+			changed = b.setCABundle(&validating.Webhooks[i].ClientConfig.CABundle, validating.Webhooks[i].ClientConfig.Service, bundle) || changed
+		}
+		if changed {
+			if _, err := admission.ValidatingWebhookConfigurations().Update(ctx, validating, metav1.UpdateOptions{}); err != nil {
+				return err
+			}
+			log.info("patched caBundle", fields{"validating_webhook_configuration": b.webhookName})
+		}
+	}
+	return nil
+}
+
+// setCABundle sets *caBundle to bundle if the webhook calls this service and
+// reports whether it changed.
+func (b *bootstrapper) setCABundle(caBundle *[]byte, service *admissionregistrationv1.ServiceReference, bundle []byte) bool {
+	if service == nil || service.Name != b.serviceName || service.Namespace != b.namespace || bytes.Equal(*caBundle, bundle) {
+		return false
+	}
+	*caBundle = bundle
+	return true
+}
+
+// newCertificate creates a certificate from tmpl with a new P-256 key, signed
+// by parent, or self-signed when parent is nil.
+func newCertificate(tmpl, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	if tmpl.SerialNumber, err = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128)); err != nil {
+		return nil, nil, nil, nil, err
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	return cert, key,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+// parseCertificates returns the certificates in data, skipping invalid ones.
+func parseCertificates(data []byte) []*x509.Certificate {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return certs
+		}
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			certs = append(certs, cert)
+		}
+	}
+}
+
+func parseKey(data []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM encoded key")
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+func sameNames(a, b []string) bool {
+	a, b = append([]string(nil), a...), append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestBootstrapCertificates(t *testing.T) {
+	service := &admissionregistrationv1.ServiceReference{Name: "secret-inject", Namespace: "default"}
+	other := &admissionregistrationv1.ServiceReference{Name: "other", Namespace: "default"}
+	client := fake.NewSimpleClientset(
+		&admissionregistrationv1.MutatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: "aws-secret-inject"},
+			Webhooks: []admissionregistrationv1.MutatingWebhook{
+				{Name: "secret-inject.k8s.aws", ClientConfig: admissionregistrationv1.WebhookClientConfig{Service: service}},
+				{Name: "other.k8s.aws", ClientConfig: admissionregistrationv1.WebhookClientConfig{Service: other}},
+			},
+		},
+		&admissionregistrationv1.ValidatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: "aws-secret-inject"},
+			Webhooks: []admissionregistrationv1.ValidatingWebhook{
+				{Name: "secret-inject.k8s.aws", ClientConfig: admissionregistrationv1.WebhookClientConfig{Service: service}},
+			},
+		},
+	)
+	now := time.Now()
+	b := &bootstrapper{
+		client:      client,
+		namespace:   "default",
+		secretName:  "secret-inject-tls",
+		serviceName: "secret-inject",
+		webhookName: "aws-secret-inject",
+		now:         func() time.Time { return now },
+	}
+	ctx := context.Background()
+
+	reconcile := func() map[string][]byte {
+		t.Helper()
+		if err := b.reconcile(ctx); err != nil {
+			t.Fatal(err)
+		}
+		secret, err := client.CoreV1().Secrets("default").Get(ctx, "secret-inject-tls", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		mutating, _ := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(ctx, "aws-secret-inject", metav1.GetOptions{})
+		validating, _ := client.AdmissionregistrationV1().ValidatingWebhookConfigurations().Get(ctx, "aws-secret-inject", metav1.GetOptions{})
+		for _, bundle := range [][]byte{mutating.Webhooks[0].ClientConfig.CABundle, validating.Webhooks[0].ClientConfig.CABundle} {
+			if !bytes.Equal(bundle, secret.Data[secretCACert]) {
+				t.Errorf("caBundle was not patched with the CA of the secret")
+			}
+		}
+		if mutating.Webhooks[1].ClientConfig.CABundle != nil {
+			t.Errorf("caBundle of a webhook calling another service was patched")
+		}
+
+		// The serving certificate is trusted by the API server.
+		roots := x509.NewCertPool()
+		roots.AppendCertsFromPEM(secret.Data[secretCACert])
+		leaf := parseCertificates(secret.Data[corev1.TLSCertKey])[0]
+		if _, err := leaf.Verify(x509.VerifyOptions{DNSName: "secret-inject.default.svc", Roots: roots, CurrentTime: now}); err != nil {
+			t.Errorf("serving certificate does not verify: %v", err)
+		}
+		// Every replica can serve it.
+		store := &certStore{}
+		b.load(store, secret)
+		if _, err := store.getCertificate(nil); err != nil {
+			t.Error(err)
+		}
+		return secret.Data
+	}
+
+	first := reconcile()
+	if second := reconcile(); !bytes.Equal(first[corev1.TLSCertKey], second[corev1.TLSCertKey]) || !bytes.Equal(first[secretCACert], second[secretCACert]) {
+		t.Error("certificates were replaced although they are valid")
+	}
+
+	// The serving certificate is rotated 90 days before it expires.
+	now = now.Add(300 * 24 * time.Hour)
+	rotated := reconcile()
+	if bytes.Equal(first[corev1.TLSCertKey], rotated[corev1.TLSCertKey]) {
+		t.Error("expiring serving certificate was not rotated")
+	}
+	if !bytes.Equal(first[secretCACert], rotated[secretCACert]) {
+		t.Error("CA was rotated with the serving certificate")
+	}
+
+	// The CA is rotated a year before it expires, and the previous CA is
+	// still trusted.
+	now = now.Add(9 * 365 * 24 * time.Hour)
+	rotated = reconcile()
+	bundle := parseCertificates(rotated[secretCACert])
+	if len(bundle) != 2 || !bundle[1].Equal(parseCertificates(first[secretCACert])[0]) {
+		t.Errorf("expected the new and the previous CA in the bundle, got %d certificates", len(bundle))
+	}
+	if err := parseCertificates(rotated[corev1.TLSCertKey])[0].CheckSignatureFrom(bundle[0]); err != nil {
+		t.Errorf("serving certificate was not issued by the new CA: %v", err)
+	}
+}
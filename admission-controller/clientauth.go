@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clientAuth authenticates the callers of the admission endpoints with their
+// client certificate. The certificate must be issued by a CA of the bundle
+// in path and, when allowed is not empty, have one of the allowed names as
+// its subject common name or as a DNS, URI or email SAN.
+//
+// The certificate is verified if given during the handshake and required by
+// requireClient, so that /readyz and /metrics remain reachable by probes and
+// scrapers that have no client certificate.
+type clientAuth struct {
+	path    string
+	allowed map[string]bool
+
+	mu       sync.RWMutex
+	pool     *x509.CertPool
+	contents []byte
+}
+
+// loadClientAuth reads the CA bundle at path. allowed is a comma separated
+// list of names.
+func loadClientAuth(path, allowed string) (*clientAuth, error) {
+	a := &clientAuth{path: path, allowed: map[string]bool{}}
+	for _, name := range strings.Split(allowed, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			a.allowed[name] = true
+		}
+	}
+	if err := a.reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// reload reads the CA bundle again and replaces it if it changed. A bundle
+// without any certificate is rejected and the previous one is kept.
+func (a *clientAuth) reload() error {
+	contents, err := ioutil.ReadFile(a.path)
+	if err != nil {
+		return err
+	}
+	a.mu.RLock()
+	unchanged := a.pool != nil && bytes.Equal(contents, a.contents)
+	a.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(contents) {
+		return fmt.Errorf("%s contains no PEM encoded certificate", a.path)
+	}
+	a.mu.Lock()
+	a.pool, a.contents = pool, contents
+	a.mu.Unlock()
+	log.info("loaded client CA bundle", fields{"path": a.path})
+	return nil
+}
+
+// watch reloads the CA bundle every interval until stop is closed.
+func (a *clientAuth) watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := a.reload(); err != nil {
+				log.error("unable to reload client CA bundle, keeping the previous one", fields{"path": a.path, fieldError: err})
+			}
+		}
+	}
+}
+
+// configure makes config verify the client certificates against the current
+// CA bundle.
+func (a *clientAuth) configure(config *tls.Config) {
+	base := config.Clone()
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c := base.Clone()
+		c.ClientAuth = tls.VerifyClientCertIfGiven
+		a.mu.RLock()
+		c.ClientCAs = a.pool
+		a.mu.RUnlock()
+		return c, nil
+	}
+}
+
+// authorize returns why the caller of a request on a connection in state is
+// not allowed, or nil.
+func (a *clientAuth) authorize(state *tls.ConnectionState) error {
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return fmt.Errorf("no client certificate issued by a trusted CA")
+	}
+	cert := state.VerifiedChains[0][0]
+	if len(a.allowed) == 0 {
+		return nil
+	}
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	for _, name := range names {
+		if a.allowed[name] {
+			return nil
+		}
+	}
+	return fmt.Errorf("client certificate %q is not allowed", cert.Subject.CommonName)
+}
+
+// requireClient rejects the requests to h whose caller is not authenticated
+// by a. Every request is passed to h when a is nil.
+func requireClient(a *clientAuth, h http.HandlerFunc) http.HandlerFunc {
+	if a == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := a.authorize(r.TLS); err != nil {
+			log.info("rejected client", fields{"remote_addr": r.RemoteAddr, "path": r.URL.Path, fieldError: err})
+			code := http.StatusForbidden
+			if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+				code = http.StatusUnauthorized
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+		h(w, r)
+	}
+}
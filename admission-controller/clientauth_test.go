@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newClientCert issues a client certificate for commonName signed by ca.
+func newClientCert(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, commonName string) tls.Certificate {
+	_, _, certPEM, keyPEM, err := newCertificate(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: commonName},
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().Add(time.Hour),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func newTestCA(t *testing.T, name string) (*x509.Certificate, *ecdsa.PrivateKey, []byte) {
+	ca, key, certPEM, _, err := newCertificate(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca, key, certPEM
+}
+
+func TestClientAuth(t *testing.T) {
+	ca, caKey, caPEM := newTestCA(t, "client-ca")
+	otherCA, otherKey, _ := newTestCA(t, "other-ca")
+	path := filepath.Join(t.TempDir(), "client-ca.crt")
+	if err := ioutil.WriteFile(path, caPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	auth, err := loadClientAuth(path, "kube-apiserver, apiserver.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mutating-pods", requireClient(auth, func(w http.ResponseWriter, r *http.Request) {}))
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {})
+	server := httptest.NewUnstartedServer(mux)
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{newClientCert(t, ca, caKey, "secret-inject")}}
+	auth.configure(server.TLS)
+	server.StartTLS()
+	defer server.Close()
+
+	get := func(path string, certs ...tls.Certificate) int {
+		t.Helper()
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			// Send the certificate even if the server asks for another CA.
+			GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				if len(certs) == 0 {
+					return &tls.Certificate{}, nil
+				}
+				return &certs[0], nil
+			},
+		}}}
+		resp, err := client.Get(server.URL + path)
+		if err != nil {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	testCases := []struct {
+		name  string
+		path  string
+		certs []tls.Certificate
+		want  int
+	}{
+		{"API server", "/mutating-pods", []tls.Certificate{newClientCert(t, ca, caKey, "kube-apiserver")}, http.StatusOK},
+		{"no certificate", "/mutating-pods", nil, http.StatusUnauthorized},
+		{"name not allowed", "/mutating-pods", []tls.Certificate{newClientCert(t, ca, caKey, "intruder")}, http.StatusForbidden},
+		// The handshake fails for a certificate of another CA.
+		{"untrusted CA", "/mutating-pods", []tls.Certificate{newClientCert(t, otherCA, otherKey, "kube-apiserver")}, 0},
+		{"probe", "/readyz", nil, http.StatusOK},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := get(tc.path, tc.certs...); got != tc.want {
+				t.Errorf("status = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
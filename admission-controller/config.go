@@ -17,25 +17,138 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
-
-	"k8s.io/klog"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
 )
 
 // Config contains the server (the webhook) cert and key.
 type Config struct {
 	CertFile string
 	KeyFile  string
+	// Bootstrap, when set, generates the certificates and stores them in
+	// a Secret instead of reading them from CertFile and KeyFile.
+	Bootstrap *bootstrapper
+	// ClientAuth, when set, verifies the client certificates of the callers.
+	ClientAuth *clientAuth
 }
 
 func configTLS(config Config) *tls.Config {
-	sCert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	store := &certStore{}
+	if config.Bootstrap != nil {
+		if err := config.Bootstrap.start(context.Background(), store); err != nil {
+			log.error("unable to bootstrap webhook certificate", fields{fieldError: err})
+			os.Exit(1)
+		}
+	} else {
+		certs, err := newCertReloader(config.CertFile, config.KeyFile)
+		if err != nil {
+			log.error("unable to load webhook certificate", fields{fieldError: err})
+			os.Exit(1)
+		}
+		store = certs.certStore
+		go certs.watch(certReloadInterval, make(chan struct{}))
+	}
+	tlsConfig := &tls.Config{GetCertificate: store.getCertificate}
+	if config.ClientAuth != nil {
+		config.ClientAuth.configure(tlsConfig)
+	}
+	return tlsConfig
+}
+
+// certStore holds the serving certificate. It is replaced when the
+// certificate is rotated, so that new connections use the new certificate
+// without a restart.
+type certStore struct {
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	contents []byte
+}
+
+// set replaces the certificate with the PEM encoded pair, if it changed and
+// is valid. Otherwise the previous certificate is kept.
+func (s *certStore) set(certPEM, keyPEM []byte) error {
+	contents := append(append([]byte(nil), certPEM...), keyPEM...)
+	s.mu.RLock()
+	unchanged := s.cert != nil && bytes.Equal(contents, s.contents)
+	s.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	cert.Leaf = leaf
+	s.mu.Lock()
+	s.cert, s.contents = &cert, contents
+	s.mu.Unlock()
+	certificateExpiry.Set(float64(leaf.NotAfter.Unix()))
+	log.info("loaded webhook certificate", fields{"not_after": leaf.NotAfter.UTC().Format(time.RFC3339)})
+	return nil
+}
+
+func (s *certStore) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.cert == nil {
+		return nil, fmt.Errorf("no webhook certificate has been loaded yet")
+	}
+	return s.cert, nil
+}
+
+// certReloader loads the certificate in a pair of files into a certStore and
+// reloads it when the files change, e.g. when cert-manager renews it.
+type certReloader struct {
+	*certStore
+	certFile, keyFile string
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certStore: &certStore{}, certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload reads the files again and replaces the certificate if they changed.
+func (r *certReloader) reload() error {
+	certPEM, err := ioutil.ReadFile(r.certFile)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := ioutil.ReadFile(r.keyFile)
 	if err != nil {
-		klog.Fatal(err)
+		return err
 	}
-	return &tls.Config{
-		Certificates: []tls.Certificate{sCert},
-		// TODO: uses mutual tls after we agree on what cert the apiserver should use.
-		// ClientAuth:   tls.RequireAndVerifyClientCert,
+	return r.set(certPEM, keyPEM)
+}
+
+// watch reloads the certificate every interval until stop is closed. Secrets
+// are mounted through a symlink that is swapped on update, so the files are
+// polled rather than watched with inotify.
+func (r *certReloader) watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := r.reload(); err != nil {
+				log.error("unable to reload webhook certificate, keeping the previous one", fields{fieldError: err})
+			}
+		}
 	}
 }
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// writeCertificate writes a self-signed serving certificate that expires at
+// notAfter to certFile and keyFile.
+func writeCertificate(t *testing.T, certFile, keyFile string, notAfter time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "secret-inject.default.svc"},
+		DNSNames:     []string{"secret-inject.default.svc"},
+		NotBefore:    notAfter.Add(-24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	notAfter := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	writeCertificate(t, certFile, keyFile, notAfter)
+
+	tlsConfig := configTLS(Config{CertFile: certFile, KeyFile: keyFile})
+	cert, err := tlsConfig.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cert.Leaf.NotAfter.Equal(notAfter) {
+		t.Errorf("NotAfter = %v, want %v", cert.Leaf.NotAfter, notAfter)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	first := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	writeCertificate(t, certFile, keyFile, first)
+
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notAfter := func() time.Time {
+		cert, _ := r.getCertificate(nil)
+		return cert.Leaf.NotAfter
+	}
+	if !notAfter().Equal(first) {
+		t.Errorf("NotAfter = %v, want %v", notAfter(), first)
+	}
+	if got := testutil.ToFloat64(certificateExpiry); got != float64(first.Unix()) {
+		t.Errorf("expiry metric = %v, want %v", got, first.Unix())
+	}
+
+	rotated := first.Add(90 * 24 * time.Hour)
+	writeCertificate(t, certFile, keyFile, rotated)
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !notAfter().Equal(rotated) {
+		t.Errorf("rotated certificate was not loaded, NotAfter = %v", notAfter())
+	}
+	if got := testutil.ToFloat64(certificateExpiry); got != float64(rotated.Unix()) {
+		t.Errorf("expiry metric = %v, want %v", got, rotated.Unix())
+	}
+
+	// A half-written rotation, with a key that does not match, keeps the
+	// previous certificate.
+	if err := ioutil.WriteFile(keyFile, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.reload(); err == nil {
+		t.Error("expected an invalid key to be rejected")
+	}
+	if !notAfter().Equal(rotated) {
+		t.Errorf("previous certificate was not kept, NotAfter = %v", notAfter())
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// Annotations that override the settings of the injected containers for a
+// single pod.
+const (
+	annotationCPURequest       = "secrets.k8s.aws/cpu-request"
+	annotationMemoryRequest    = "secrets.k8s.aws/memory-request"
+	annotationCPULimit         = "secrets.k8s.aws/cpu-limit"
+	annotationMemoryLimit      = "secrets.k8s.aws/memory-limit"
+	annotationImagePullPolicy  = "secrets.k8s.aws/image-pull-policy"
+	annotationImagePullSecrets = "secrets.k8s.aws/image-pull-secrets"
+	annotationImage            = "secrets.k8s.aws/image"
+)
+
+// Settings of the injected containers, set by flags. An empty quantity leaves
+// the request or limit unset.
+var (
+	cpuRequest       string
+	memoryRequest    string
+	cpuLimit         string
+	memoryLimit      string
+	imagePullPolicy  string
+	imagePullSecrets string
+	// hardenContainers selects the restricted security context for the
+	// injected containers.
+	hardenContainers bool
+	// initContainerPosition places the injected init containers before or
+	// after those of the pod.
+	initContainerPosition string
+)
+
+// nonRootUser is the user the injected containers run as under the hardened
+// security context. The fetcher only writes to the secret volume, which is
+// writable by every user.
+const nonRootUser = 65532
+
+// checkContainerFlags reports invalid container settings at startup, so that
+// they are not discovered on the first admission.
+func checkContainerFlags() error {
+	for flag, value := range map[string]string{
+		"cpu-request":    cpuRequest,
+		"memory-request": memoryRequest,
+		"cpu-limit":      cpuLimit,
+		"memory-limit":   memoryLimit,
+	} {
+		if _, err := parseQuantity(value); err != nil {
+			return fmt.Errorf("--%s: %v", flag, err)
+		}
+	}
+	if !validPullPolicy(imagePullPolicy) {
+		return fmt.Errorf("--image-pull-policy must be Always, IfNotPresent or Never")
+	}
+	if _, err := parseHealthPort(strconv.Itoa(healthPort)); err != nil {
+		return fmt.Errorf("--health-port: %v", err)
+	}
+	if initContainerPosition != positionFirst && initContainerPosition != positionLast {
+		return fmt.Errorf("--init-container-position must be %s or %s", positionFirst, positionLast)
+	}
+	return nil
+}
+
+// containerResources returns the resources of the injected containers, taken
+// from the flags unless the pod overrides them. Invalid annotations are
+// logged and ignored.
+func containerResources(annotations map[string]string) corev1.ResourceRequirements {
+	resources := corev1.ResourceRequirements{Requests: corev1.ResourceList{}, Limits: corev1.ResourceList{}}
+	for _, setting := range []struct {
+		list       corev1.ResourceList
+		name       corev1.ResourceName
+		annotation string
+		value      string
+	}{
+		{resources.Requests, corev1.ResourceCPU, annotationCPURequest, cpuRequest},
+		{resources.Requests, corev1.ResourceMemory, annotationMemoryRequest, memoryRequest},
+		{resources.Limits, corev1.ResourceCPU, annotationCPULimit, cpuLimit},
+		{resources.Limits, corev1.ResourceMemory, annotationMemoryLimit, memoryLimit},
+	} {
+		value := setting.value
+		if v, ok := annotations[setting.annotation]; ok {
+			if _, err := parseQuantity(v); err != nil {
+				log.info("ignoring invalid annotation", fields{"annotation": setting.annotation, fieldError: err})
+			} else {
+				value = v
+			}
+		}
+		if q, _ := parseQuantity(value); q != nil {
+			setting.list[setting.name] = *q
+		}
+	}
+	if len(resources.Requests) == 0 {
+		resources.Requests = nil
+	}
+	if len(resources.Limits) == 0 {
+		resources.Limits = nil
+	}
+	return resources
+}
+
+// parseQuantity parses s, returning nil for an empty string.
+func parseQuantity(s string) (*resource.Quantity, error) {
+	if s == "" {
+		return nil, nil
+	}
+	q, err := resource.ParseQuantity(s)
+	if err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+// containerImage returns the image of the injected containers. The image
+// annotation is only used when it names one of --allowed-images, since the
+// injected containers are trusted with the credentials of the pod and their
+// environment is checked against the access policies.
+func containerImage(annotations map[string]string) string {
+	if v := annotations[annotationImage]; v != "" {
+		if imageAllowed(v) {
+			return v
+		}
+		log.info("ignoring annotation", fields{"annotation": annotationImage, "reason": "image not in --allowed-images"})
+	}
+	return sidecarImage
+}
+
+// imageAllowed reports whether image is one of --allowed-images.
+func imageAllowed(image string) bool {
+	for _, allowed := range strings.Split(allowedImages, ",") {
+		if allowed = strings.TrimSpace(allowed); allowed != "" && allowed == image {
+			return true
+		}
+	}
+	return false
+}
+
+// containerPullPolicy returns the pull policy of the injected containers.
+func containerPullPolicy(annotations map[string]string) corev1.PullPolicy {
+	if v, ok := annotations[annotationImagePullPolicy]; ok {
+		if validPullPolicy(v) {
+			return corev1.PullPolicy(v)
+		}
+		log.info("ignoring invalid annotation", fields{"annotation": annotationImagePullPolicy})
+	}
+	return corev1.PullPolicy(imagePullPolicy)
+}
+
+func validPullPolicy(p string) bool {
+	switch corev1.PullPolicy(p) {
+	case corev1.PullAlways, corev1.PullIfNotPresent, corev1.PullNever:
+		return true
+	}
+	return false
+}
+
+// addImagePullSecrets adds the pull secrets of the fetcher image, from the
+// flag and the pod annotation, to pod.
+func addImagePullSecrets(pod *corev1.Pod) {
+	names := strings.Split(imagePullSecrets+","+pod.ObjectMeta.Annotations[annotationImagePullSecrets], ",")
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" || hasPullSecret(pod.Spec.ImagePullSecrets, name) {
+			continue
+		}
+		pod.Spec.ImagePullSecrets = append(pod.Spec.ImagePullSecrets, corev1.LocalObjectReference{Name: name})
+	}
+}
+
+func hasPullSecret(secrets []corev1.LocalObjectReference, name string) bool {
+	for _, s := range secrets {
+		if s.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// containerSecurityContext returns the security context of the injected
+// containers: one that satisfies the restricted Pod Security Standard, or
+// none when hardening is disabled.
+func containerSecurityContext() *corev1.SecurityContext {
+	if !hardenContainers {
+		return nil
+	}
+	yes, no := true, false
+	user := int64(nonRootUser)
+	return &corev1.SecurityContext{
+		RunAsNonRoot:             &yes,
+		RunAsUser:                &user,
+		RunAsGroup:               &user,
+		ReadOnlyRootFilesystem:   &yes,
+		AllowPrivilegeEscalation: &no,
+		Capabilities:             &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}},
+		SeccompProfile:           &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault},
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Values of --credentials-policy, which selects what happens to pods that
+// request secrets but have no AWS credentials.
+const (
+	credentialsIgnore = "ignore"
+	credentialsWarn   = "warn"
+	credentialsDeny   = "deny"
+)
+
+const (
+	// annotationRoleArn is set on a ServiceAccount to configure IAM roles
+	// for service accounts (IRSA).
+	annotationRoleArn = "eks.amazonaws.com/role-arn"
+	// irsaRoleEnv, irsaTokenEnv and irsaVolume are added to pods by the EKS
+	// Pod Identity webhook when the ServiceAccount has an IRSA role.
+	irsaRoleEnv  = "AWS_ROLE_ARN"
+	irsaTokenEnv = "AWS_WEB_IDENTITY_TOKEN_FILE"
+	irsaVolume   = "aws-iam-token"
+	// irsaTokenPath and irsaAudience are where and for whom the webhook
+	// projects the service account token of IRSA.
+	irsaTokenPath = "/var/run/secrets/eks.amazonaws.com/serviceaccount"
+	irsaAudience  = "sts.amazonaws.com"
+	// podIdentityEnv, podIdentityTokenEnv and podIdentityVolume are added to
+	// pods by EKS when the ServiceAccount has a Pod Identity association.
+	podIdentityEnv      = "AWS_CONTAINER_CREDENTIALS_FULL_URI"
+	podIdentityTokenEnv = "AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"
+	podIdentityVolume   = "eks-pod-identity-token"
+)
+
+// credentialEnv are the environment variables through which EKS gives
+// containers their credentials.
+var credentialEnv = map[string]bool{
+	irsaRoleEnv:                  true,
+	irsaTokenEnv:                 true,
+	"AWS_STS_REGIONAL_ENDPOINTS": true,
+	podIdentityEnv:               true,
+	podIdentityTokenEnv:          true,
+}
+
+// regionEnv are the environment variables that set the region, which are
+// copied along with the credentials. Containers often set them alone, so
+// they do not make a container a source of credentials.
+var regionEnv = []string{"AWS_REGION", "AWS_DEFAULT_REGION"}
+
+// serviceAccounts caches the ServiceAccounts of the cluster. It is nil, and
+// credentials are not checked, when the policy is ignore.
+var serviceAccounts corelisters.ServiceAccountLister
+
+// startServiceAccountInformer fills serviceAccounts from an informer and
+// waits for the cache to sync.
+func startServiceAccountInformer(stop <-chan struct{}) error {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return err
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+	factory := informers.NewSharedInformerFactory(client, 10*time.Minute)
+	informer := factory.Core().V1().ServiceAccounts()
+	lister := informer.Lister()
+	factory.Start(stop)
+	if !cache.WaitForCacheSync(stop, informer.Informer().HasSynced) {
+		return fmt.Errorf("service account cache did not sync")
+	}
+	serviceAccounts = lister
+	return nil
+}
+
+// checkCredentials looks up how pod, in namespace, gets AWS credentials. It
+// returns the audit annotations recording them, and a problem when the pod
+// has none. The problem is a warning or a denial according to the policy.
+func checkCredentials(pod *corev1.Pod, namespace string) (audit map[string]string, problem string) {
+	if serviceAccounts == nil {
+		return nil, ""
+	}
+	name := pod.Spec.ServiceAccountName
+	if name == "" {
+		name = "default"
+	}
+	sa, err := serviceAccounts.ServiceAccounts(namespace).Get(name)
+	if err != nil && !errors.IsNotFound(err) {
+		log.error("unable to look up service account", fields{fieldNamespace: namespace, "service_account": name, fieldError: err})
+		return nil, ""
+	}
+	if sa != nil && sa.Annotations[annotationRoleArn] != "" {
+		return map[string]string{"credentials": "irsa", "role-arn": sa.Annotations[annotationRoleArn]}, ""
+	}
+	if hasPodIdentity(pod) {
+		return map[string]string{"credentials": "pod-identity"}, ""
+	}
+	return map[string]string{"credentials": "none"}, fmt.Sprintf(
+		"service account %s has no %s annotation and no EKS Pod Identity association, the secrets cannot be retrieved", name, annotationRoleArn)
+}
+
+// podCredentials returns the environment variables and token volume mounts
+// that give the injected containers of pod the IRSA or Pod Identity
+// credentials of the pod.
+//
+// EKS adds them to every container of the pod it mutates, including those
+// injected by webhooks called before it. When it was called first they are
+// copied, with the region, from the first container of the pod that has
+// IRSA or Pod Identity credentials. When it was not called yet, the
+// ServiceAccount of the pod is looked up instead, see
+// serviceAccountCredentials.
+func podCredentials(pod *corev1.Pod) ([]corev1.EnvVar, []corev1.VolumeMount) {
+	for _, containers := range [][]corev1.Container{pod.Spec.Containers, pod.Spec.InitContainers} {
+		for _, c := range containers {
+			if c.Name == initContainerName || c.Name == refreshContainerName {
+				continue
+			}
+			if !(hasEnv(c, irsaRoleEnv) && hasEnv(c, irsaTokenEnv)) && !hasEnv(c, podIdentityEnv) {
+				continue
+			}
+			var env []corev1.EnvVar
+			for _, e := range c.Env {
+				if credentialEnv[e.Name] || contains(regionEnv, e.Name) {
+					env = append(env, e)
+				}
+			}
+			var mounts []corev1.VolumeMount
+			for _, m := range c.VolumeMounts {
+				if m.Name == irsaVolume || m.Name == podIdentityVolume {
+					mounts = append(mounts, m)
+				}
+			}
+			return env, mounts
+		}
+	}
+	return serviceAccountCredentials(pod)
+}
+
+// serviceAccountCredentials returns the IRSA environment variables and token
+// volume mount that EKS gives the containers of pod when its ServiceAccount
+// has an IRSA role, with the region that a container of the pod sets, or
+// else the region of the cluster. ServiceAccounts are only watched when the credentials
+// policy is not ignore. Pod Identity associations are not recorded on the
+// ServiceAccount, so pods that EKS has not mutated get no Pod Identity
+// credentials.
+func serviceAccountCredentials(pod *corev1.Pod) ([]corev1.EnvVar, []corev1.VolumeMount) {
+	if serviceAccounts == nil || pod.Namespace == "" {
+		return nil, nil
+	}
+	name := pod.Spec.ServiceAccountName
+	if name == "" {
+		name = "default"
+	}
+	sa, err := serviceAccounts.ServiceAccounts(pod.Namespace).Get(name)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			log.error("unable to look up service account", fields{fieldNamespace: pod.Namespace, "service_account": name, fieldError: err})
+		}
+		return nil, nil
+	}
+	role := sa.Annotations[annotationRoleArn]
+	if role == "" {
+		return nil, nil
+	}
+	env := []corev1.EnvVar{
+		{Name: irsaRoleEnv, Value: role},
+		{Name: irsaTokenEnv, Value: irsaTokenPath + "/token"},
+	}
+	return append(env, podRegion(pod)...), []corev1.VolumeMount{{Name: irsaVolume, MountPath: irsaTokenPath, ReadOnly: true}}
+}
+
+// addCredentials gives the injected containers of pod the credentials of
+// podCredentials that they lack, which happens when EKS mutated the pod
+// after they were injected and this webhook is reinvoked, and adds the IRSA
+// token volume when they mount it and the pod does not have it.
+func addCredentials(pod *corev1.Pod) {
+	env, mounts := podCredentials(pod)
+	mountsToken := false
+	for _, containers := range [][]corev1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for i := range containers {
+			c := &containers[i]
+			if c.Name == initContainerName || c.Name == refreshContainerName {
+				for _, e := range env {
+					if !hasEnv(*c, e.Name) {
+						c.Env = append(c.Env, e)
+					}
+				}
+				for _, m := range mounts {
+					if !mountsVolume(*c, m.Name) {
+						c.VolumeMounts = append(c.VolumeMounts, m)
+					}
+				}
+			}
+			mountsToken = mountsToken || mountsVolume(*c, irsaVolume)
+		}
+	}
+	if !mountsToken {
+		return
+	}
+	for _, v := range pod.Spec.Volumes {
+		if v.Name == irsaVolume {
+			return
+		}
+	}
+	expiration := int64(86400)
+	pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+		Name: irsaVolume,
+		VolumeSource: corev1.VolumeSource{Projected: &corev1.ProjectedVolumeSource{
+			Sources: []corev1.VolumeProjection{{ServiceAccountToken: &corev1.ServiceAccountTokenProjection{
+				Audience:          irsaAudience,
+				ExpirationSeconds: &expiration,
+				Path:              "token",
+			}}},
+		}},
+	})
+}
+
+// podRegion returns the region environment variables of the first container
+// of pod that sets one, or sets both to --region when none does.
+func podRegion(pod *corev1.Pod) []corev1.EnvVar {
+	for _, containers := range [][]corev1.Container{pod.Spec.Containers, pod.Spec.InitContainers} {
+		for _, c := range containers {
+			if c.Name == initContainerName || c.Name == refreshContainerName {
+				continue
+			}
+			var env []corev1.EnvVar
+			for _, e := range c.Env {
+				if contains(regionEnv, e.Name) {
+					env = append(env, e)
+				}
+			}
+			if len(env) > 0 {
+				return env
+			}
+		}
+	}
+	if clusterRegion == "" {
+		return nil
+	}
+	var env []corev1.EnvVar
+	for _, name := range regionEnv {
+		env = append(env, corev1.EnvVar{Name: name, Value: clusterRegion})
+	}
+	return env
+}
+
+func hasEnv(c corev1.Container, name string) bool {
+	for _, e := range c.Env {
+		if e.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPodIdentity reports whether EKS injected Pod Identity credentials into
+// pod.
+func hasPodIdentity(pod *corev1.Pod) bool {
+	for _, v := range pod.Spec.Volumes {
+		if v.Name == podIdentityVolume {
+			return true
+		}
+	}
+	for _, containers := range [][]corev1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for _, c := range containers {
+			for _, e := range c.Env {
+				if e.Name == podIdentityEnv {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
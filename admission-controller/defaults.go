@@ -0,0 +1,67 @@
+package main
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+// namespaceDefaults are the annotations that a Namespace can set for all of
+// its pods. The mount path and filename are defaults of the unindexed
+// secret. The secret ARNs and the inject and injected annotations are never
+// taken from the Namespace.
+var namespaceDefaults = []string{
+	annotationMountPath,
+	annotationSecretFilename,
+	annotationContainers,
+	annotationMode,
+	annotationRefreshInterval,
+	annotationHealthPort,
+	annotationCPURequest,
+	annotationMemoryRequest,
+	annotationCPULimit,
+	annotationMemoryLimit,
+	annotationImagePullPolicy,
+	annotationImagePullSecrets,
+	annotationImage,
+}
+
+// useNamespaceDefaults is set by --namespace-defaults.
+var useNamespaceDefaults bool
+
+// applyNamespaceDefaults copies to pod the annotations of namespace listed in
+// namespaceDefaults that pod does not set itself, so that the annotations of
+// the pod take precedence over those of its Namespace, which take precedence
+// over the flags. It returns the keys of the copied annotations.
+//
+// The defaults are copied to the pod rather than merged on the fly, so that
+// the pod records the settings it was injected with and the validating
+// webhook checks them.
+func applyNamespaceDefaults(pod *corev1.Pod, namespace string) []string {
+	if !useNamespaceDefaults || namespaces == nil || namespace == "" {
+		return nil
+	}
+	ns, err := namespaces.get(namespace)
+	if err != nil {
+		log.error("unable to look up namespace defaults", fields{fieldNamespace: namespace, fieldError: err})
+		return nil
+	}
+	_, unindexed := pod.ObjectMeta.Annotations[annotationSecretArn]
+	var applied []string
+	for _, key := range namespaceDefaults {
+		v, ok := ns.Annotations[key]
+		if !ok {
+			continue
+		}
+		if _, set := pod.ObjectMeta.Annotations[key]; set {
+			continue
+		}
+		if (key == annotationMountPath || key == annotationSecretFilename) && !unindexed {
+			continue
+		}
+		if pod.ObjectMeta.Annotations == nil {
+			pod.ObjectMeta.Annotations = map[string]string{}
+		}
+		pod.ObjectMeta.Annotations[key] = v
+		applied = append(applied, key)
+	}
+	return applied
+}
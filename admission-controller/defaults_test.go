@@ -0,0 +1,83 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestMutatePodsNamespaceDefaults(t *testing.T) {
+	sidecarImage, allowedImages = "test-image", "registry.example.com/fetcher"
+	defer func() { allowedImages = "" }()
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	indexer.Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default", Annotations: map[string]string{
+		annotationMountPath:     "/etc/secrets",
+		annotationImage:         "registry.example.com/fetcher",
+		annotationMemoryLimit:   "128Mi",
+		annotationSecretArn:     testArn,
+		annotationInject:        "false",
+		"example.com/unrelated": "x",
+	}}})
+	namespaces = &namespaceCache{lister: corelisters.NewNamespaceLister(indexer), client: fake.NewSimpleClientset()}
+	useNamespaceDefaults = true
+	defer func() { namespaces, useNamespaceDefaults = nil, false }()
+
+	pod := secretPod(map[string]string{
+		annotationSecretArn:   testArn,
+		annotationMemoryLimit: "256Mi",
+	})
+	review := podReview(t, pod)
+	resp := mutatePods(review)
+	if got, want := resp.AuditAnnotations[auditDefaults], annotationMountPath+","+annotationImage; got != want {
+		t.Errorf("namespace-defaults audit annotation = %q, want %q", got, want)
+	}
+	if len(resp.Warnings) > 0 {
+		t.Errorf("unexpected warnings %q", resp.Warnings)
+	}
+	out, err := admitPod(mutatePods, review)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		annotationSecretArn:   testArn,
+		annotationMemoryLimit: "256Mi",
+		annotationMountPath:   "/etc/secrets",
+		annotationImage:       "registry.example.com/fetcher",
+	}
+	if !reflect.DeepEqual(out.ObjectMeta.Annotations, want) {
+		t.Errorf("got annotations %v, want %v", out.ObjectMeta.Annotations, want)
+	}
+	init := out.Spec.InitContainers[0]
+	if init.Image != "registry.example.com/fetcher" {
+		t.Errorf("image = %q, want the namespace default", init.Image)
+	}
+	if limit := init.Resources.Limits[corev1.ResourceMemory]; limit.String() != "256Mi" {
+		t.Errorf("memory limit = %s, want the pod annotation to take precedence", limit.String())
+	}
+	if m := out.Spec.Containers[0].VolumeMounts; len(m) != 1 || m[0].MountPath != "/etc/secrets" {
+		t.Errorf("got mounts %v, want the secret mounted at the namespace default", m)
+	}
+	if resp := validatePods(podReview(t, out)); !resp.Allowed {
+		t.Errorf("expected the injected pod to be valid, got %#v", resp.Result)
+	}
+
+	// The mount path of the unindexed secret does not apply to named secrets.
+	named := secretPod(map[string]string{annotationSecretArn + ".db": testArn})
+	out = admit(t, mutatePods, named)
+	if _, ok := out.ObjectMeta.Annotations[annotationMountPath]; ok {
+		t.Errorf("mount path applied to a pod without the unindexed secret: %v", out.ObjectMeta.Annotations)
+	}
+	if resp := validatePods(podReview(t, out)); !resp.Allowed {
+		t.Errorf("expected the injected pod to be valid, got %#v", resp.Result)
+	}
+
+	// Pods that request no secrets are left alone.
+	if resp := mutatePods(podReview(t, secretPod(nil))); resp.Patch != nil {
+		t.Errorf("unexpected patch %s", resp.Patch)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/yaml"
+)
+
+// fileList collects the values of a repeated -f flag.
+type fileList []string
+
+func (f *fileList) String() string     { return strings.Join(*f, ",") }
+func (f *fileList) Set(v string) error { *f = append(*f, v); return nil }
+
+// runInject implements the inject command: it reads manifests from the files
+// in args, or stdin, runs the Pods and the pod templates of workloads through
+// the admission handlers, exactly as the webhook would, and writes the
+// resulting manifests to stdout. The flags of the webhook that configure the
+// injection, such as --sidecar-image, apply.
+func runInject(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("inject", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var files fileList
+	fs.Var(&files, "f", "Manifest file to inject, - for stdin. Can be repeated; defaults to stdin.")
+	flag.CommandLine.VisitAll(func(f *flag.Flag) { fs.Var(f.Value, f.Name, f.Usage) })
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if logLevel != "debug" {
+		log = &logger{out: ioutil.Discard}
+	}
+	if err := checkContainerFlags(); err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 2
+	}
+	p, err := newInjectionPolicy(allowedNamespaces, deniedNamespaces, namespaceSelector)
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 2
+	}
+	policy = p
+	if injectionTemplatePath != "" {
+		t, err := loadTemplateFile(injectionTemplatePath)
+		if err != nil {
+			fmt.Fprintf(stderr, "error: unable to load injection template: %v\n", err)
+			return 1
+		}
+		injectionTemplate = t
+	}
+
+	if len(files) == 0 {
+		files = fileList{"-"}
+	}
+	w := &manifestWriter{out: stdout}
+	for _, name := range files {
+		in := stdin
+		if name != "-" {
+			f, err := os.Open(name)
+			if err != nil {
+				fmt.Fprintf(stderr, "error: %v\n", err)
+				return 1
+			}
+			in = f
+		}
+		err := injectManifests(name, in, w, stderr)
+		if c, ok := in.(io.Closer); ok && name != "-" {
+			c.Close()
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "error: %v\n", err)
+			return 1
+		}
+	}
+	return 0
+}
+
+// manifestWriter writes manifests separated by ---.
+type manifestWriter struct {
+	out     io.Writer
+	written bool
+}
+
+func (w *manifestWriter) write(manifest []byte) error {
+	if w.written {
+		if _, err := io.WriteString(w.out, "---\n"); err != nil {
+			return err
+		}
+	}
+	w.written = true
+	_, err := w.out.Write(manifest)
+	return err
+}
+
+// injectManifests injects the secrets into every manifest of the YAML stream
+// in, read from the file name, and writes them to w. Warnings are written to
+// stderr.
+func injectManifests(name string, in io.Reader, w *manifestWriter, stderr io.Writer) error {
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(in))
+	for i := 1; ; i++ {
+		doc, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if len(bytes.TrimSpace(doc)) == 0 {
+			continue
+		}
+		out, warnings, err := injectManifest(doc)
+		for _, warning := range warnings {
+			fmt.Fprintf(stderr, "Warning: %s document %d: %s\n", name, i, warning)
+		}
+		if err != nil {
+			return fmt.Errorf("%s document %d: %v", name, i, err)
+		}
+		if err := w.write(out); err != nil {
+			return err
+		}
+	}
+}
+
+// injectManifest returns the YAML manifest doc with the secrets it requests
+// injected, and the warnings of the admission. Objects that are not Pods or
+// workloads, or that request no secrets, are returned unchanged.
+func injectManifest(doc []byte) ([]byte, []string, error) {
+	raw, err := yaml.YAMLToJSON(doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	var meta struct {
+		metav1.TypeMeta
+		Metadata metav1.ObjectMeta `json:"metadata"`
+		Items    []json.RawMessage `json:"items"`
+	}
+	if err := json.Unmarshal(raw, &meta); err != nil {
+		return nil, nil, err
+	}
+
+	if meta.Kind == "List" {
+		var warnings []string
+		var items []interface{}
+		for _, item := range meta.Items {
+			out, w, err := injectManifest(item)
+			warnings = append(warnings, w...)
+			if err != nil {
+				return nil, warnings, err
+			}
+			var obj interface{}
+			if err := yaml.Unmarshal(out, &obj); err != nil {
+				return nil, warnings, err
+			}
+			items = append(items, obj)
+		}
+		var list map[string]interface{}
+		if err := json.Unmarshal(raw, &list); err != nil {
+			return nil, warnings, err
+		}
+		list["items"] = items
+		out, err := yaml.Marshal(list)
+		return out, warnings, err
+	}
+
+	resource, admit, ok := injectionHandler(meta.GroupVersionKind())
+	if !ok {
+		return doc, nil, nil
+	}
+	review := v1.AdmissionReview{Request: &v1.AdmissionRequest{
+		UID:       "inject",
+		Namespace: meta.Metadata.Namespace,
+		Name:      meta.Metadata.Name,
+		Operation: v1.Create,
+		Resource:  resource,
+		Object:    runtime.RawExtension{Raw: raw},
+	}}
+	resp := admit(review)
+	if !resp.Allowed {
+		msg := "rejected"
+		if resp.Result != nil {
+			msg = resp.Result.Message
+		}
+		return nil, resp.Warnings, fmt.Errorf("%s", msg)
+	}
+	if resp.Patch == nil {
+		return doc, resp.Warnings, nil
+	}
+	patch, err := jsonpatch.DecodePatch(resp.Patch)
+	if err != nil {
+		return nil, resp.Warnings, err
+	}
+	patched, err := patch.Apply(raw)
+	if err != nil {
+		return nil, resp.Warnings, err
+	}
+	out, err := yaml.JSONToYAML(patched)
+	return out, resp.Warnings, err
+}
+
+// injectionHandler returns the resource of objects of kind gvk and the
+// admission handler that injects secrets into them.
+func injectionHandler(gvk schema.GroupVersionKind) (metav1.GroupVersionResource, admitv1Func, bool) {
+	if gvk == corev1.SchemeGroupVersion.WithKind("Pod") {
+		return metav1.GroupVersionResource{Version: "v1", Resource: "pods"}, mutatePods, true
+	}
+	for resource, newObject := range workloadResources {
+		kinds, _, err := scheme.ObjectKinds(newObject())
+		if err == nil && len(kinds) > 0 && kinds[0] == gvk {
+			return resource, mutateWorkloads, true
+		}
+	}
+	return metav1.GroupVersionResource{}, nil, false
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const testManifests = `apiVersion: v1
+kind: Pod
+metadata:
+  name: web
+  annotations:
+    secrets.k8s.aws/secret-arn: ` + testArn + `
+    secrets.k8s.aws/unknown: "true"
+spec:
+  containers:
+  - name: app
+    image: app
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: api
+spec:
+  selector:
+    matchLabels:
+      app: api
+  template:
+    metadata:
+      labels:
+        app: api
+      annotations:
+        secrets.k8s.aws/secret-arn: ` + testArn + `
+    spec:
+      containers:
+      - name: app
+        image: app
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings
+data:
+  key: value
+`
+
+func TestRunInject(t *testing.T) {
+	defer func(l *logger) { log = l }(log)
+	var stdout, stderr bytes.Buffer
+	if code := runInject(nil, strings.NewReader(testManifests), &stdout, &stderr); code != 0 {
+		t.Fatalf("exit code = %d, stderr: %s", code, stderr.String())
+	}
+	if !strings.Contains(stderr.String(), "Warning: - document 1: secrets.k8s.aws/unknown") {
+		t.Errorf("stderr = %q, want a warning about the unknown annotation", stderr.String())
+	}
+
+	docs := strings.Split(stdout.String(), "---\n")
+	if len(docs) != 3 {
+		t.Fatalf("got %d manifests, want 3:\n%s", len(docs), stdout.String())
+	}
+	var pod corev1.Pod
+	if err := yaml.Unmarshal([]byte(docs[0]), &pod); err != nil {
+		t.Fatal(err)
+	}
+	if len(pod.Spec.InitContainers) != 1 || len(pod.Spec.Containers[0].VolumeMounts) != 1 {
+		t.Errorf("secrets not injected into the pod: %+v", pod.Spec)
+	}
+	var deployment appsv1.Deployment
+	if err := yaml.Unmarshal([]byte(docs[1]), &deployment); err != nil {
+		t.Fatal(err)
+	}
+	template := deployment.Spec.Template
+	if len(template.Spec.InitContainers) != 1 || template.ObjectMeta.Annotations[annotationInjected] != "true" {
+		t.Errorf("secrets not injected into the pod template: %+v", template)
+	}
+	if !strings.HasSuffix(testManifests, docs[2]) {
+		t.Errorf("ConfigMap changed:\n%s", docs[2])
+	}
+}
+
+func TestRunInjectFiles(t *testing.T) {
+	defer func(l *logger) { log = l }(log)
+	dir := t.TempDir()
+	list := filepath.Join(dir, "list.yaml")
+	if err := ioutil.WriteFile(list, []byte(`apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Pod
+  metadata:
+    name: web
+    annotations:
+      secrets.k8s.aws/secret-arn: `+testArn+`
+  spec:
+    containers:
+    - name: app
+      image: app
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	conflict := filepath.Join(dir, "conflict.yaml")
+	if err := ioutil.WriteFile(conflict, []byte(`apiVersion: v1
+kind: Pod
+metadata:
+  name: web
+  annotations:
+    secrets.k8s.aws/secret-arn: `+testArn+`
+spec:
+  containers:
+  - name: app
+    image: app
+    volumeMounts:
+    - name: scratch
+      mountPath: /tmp
+  volumes:
+  - name: scratch
+    emptyDir: {}
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if code := runInject([]string{"-f", list}, nil, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit code = %d, stderr: %s", code, stderr.String())
+	}
+	var pods corev1.PodList
+	if err := yaml.Unmarshal(stdout.Bytes(), &pods); err != nil {
+		t.Fatal(err)
+	}
+	if len(pods.Items) != 1 || len(pods.Items[0].Spec.InitContainers) != 1 {
+		t.Errorf("secrets not injected into the list: %s", stdout.String())
+	}
+
+	stdout.Reset()
+	stderr.Reset()
+	if code := runInject([]string{"-f", list, "-f", conflict}, nil, &stdout, &stderr); code != 1 {
+		t.Errorf("exit code = %d, want 1", code)
+	}
+	if !strings.Contains(stderr.String(), conflict+" document 1:") {
+		t.Errorf("stderr = %q, want the rejected manifest", stderr.String())
+	}
+	if code := runInject([]string{"-f", filepath.Join(dir, "missing.yaml")}, nil, &stdout, &stderr); code != 1 {
+		t.Errorf("exit code for a missing file = %d, want 1", code)
+	}
+}
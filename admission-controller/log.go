@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Field names shared with the fetcher and the secret operator, so that logs
+// from all three binaries can be joined on them.
+const (
+	fieldPod       = "pod"
+	fieldNamespace = "namespace"
+	fieldSecretArn = "secret_arn"
+	fieldVersionID = "version_id"
+	fieldErrorCode = "error_code"
+	fieldError     = "error"
+	fieldUID       = "uid"
+)
+
+// fields holds the structured context attached to a single log line.
+type fields map[string]interface{}
+
+// logger writes one JSON object per line.
+//
+// Admission requests carry whole pod specs, including literal environment
+// variable values, so the logger only accepts scalar field values: anything
+// else (a pod, a request body, a byte slice) is replaced with its type name
+// before it is encoded. Handlers log the identifying fields of a request and
+// never the request itself.
+type logger struct {
+	mu      sync.Mutex
+	out     io.Writer
+	verbose bool
+}
+
+var log = &logger{out: os.Stderr}
+
+func (l *logger) debug(msg string, f fields) {
+	if l.verbose {
+		l.write("debug", msg, f)
+	}
+}
+
+func (l *logger) info(msg string, f fields) {
+	l.write("info", msg, f)
+}
+
+func (l *logger) error(msg string, f fields) {
+	l.write("error", msg, f)
+}
+
+func (l *logger) write(level, msg string, f fields) {
+	entry := map[string]interface{}{}
+	for k, v := range f {
+		entry[k] = scalar(v)
+	}
+	entry["level"] = level
+	entry["msg"] = msg
+	entry["ts"] = time.Now().UTC().Format(time.RFC3339Nano)
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line, _ = json.Marshal(fields{"level": "error", "msg": "unable to encode log entry"})
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(append(line, '\n'))
+}
+
+// scalar returns v if it is a string, number or boolean (including named types
+// such as types.UID), the message of an error, and a placeholder otherwise.
+// Generated API types implement fmt.Stringer by dumping every field, so
+// Stringers are deliberately not trusted.
+func scalar(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	if err, ok := v.(error); ok {
+		return err.Error()
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.String:
+		return rv.String()
+	case reflect.Bool:
+		return rv.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return rv.Uint()
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	}
+	return fmt.Sprintf("[REDACTED %T]", v)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestServeDoesNotLogPodSpec(t *testing.T) {
+	const secretValue = "literal-env-password-0xdeadbeef"
+	var buf bytes.Buffer
+	defer func(out *logger) { log = out }(log)
+	log = &logger{out: &buf, verbose: true}
+
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "web",
+			Namespace:   "default",
+			Annotations: map[string]string{"secrets.k8s.aws/secret-arn": "arn:aws:secretsmanager:us-east-1:123456789012:secret:db"},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Name:  "app",
+				Image: "app",
+				Env:   []corev1.EnvVar{{Name: "DB_PASSWORD", Value: secretValue}},
+			}},
+		},
+	}
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	review := v1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &v1.AdmissionRequest{
+			UID:       "uid-1",
+			Namespace: "default",
+			Name:      "web",
+			Operation: v1.Create,
+			Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	}
+	body, err := json.Marshal(review)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/mutating-pods", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	serveMutatePods(httptest.NewRecorder(), req)
+
+	out := buf.String()
+	if out == "" {
+		t.Fatal("expected log output")
+	}
+	if strings.Contains(out, secretValue) {
+		t.Errorf("log output contains an environment variable value:\n%s", out)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Errorf("log line is not JSON: %v: %s", err, line)
+		}
+	}
+}
+
+func TestLoggerRejectsNonScalarFields(t *testing.T) {
+	var buf bytes.Buffer
+	l := &logger{out: &buf}
+	l.info("test", fields{
+		"pod":   &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Env: []corev1.EnvVar{{Value: "s3cr3t"}}}}}},
+		"bytes": []byte("s3cr3t"),
+		"uid":   "abc",
+	})
+	if strings.Contains(buf.String(), "s3cr3t") {
+		t.Errorf("log output contains a non-scalar value:\n%s", buf.String())
+	}
+	if !strings.Contains(buf.String(), `"uid":"abc"`) {
+		t.Errorf("expected scalar field in output:\n%s", buf.String())
+	}
+}
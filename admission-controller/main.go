@@ -22,20 +22,55 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"time"
 
 	v1 "k8s.io/api/admission/v1"
 	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/klog"
-	// TODO: try this library to see if it generates correct json patch
-	// https://github.com/mattbaird/jsonpatch
+	"k8s.io/apimachinery/pkg/types"
 )
 
+// version is reported in the audit annotations of the pods secrets are
+// injected into. It is set at build time with
+// -ldflags "-X main.version=v0.1.6", which the Dockerfile passes from its
+// VERSION build argument.
+var version = "dev"
+
 var (
 	certFile string
 	keyFile  string
 	port     int
         sidecarImage string
+	logLevel string
+
+	allowedImages string
+
+	nativeSidecars bool
+	warnOnly       bool
+	clusterRegion  string
+
+	credentialsPolicy string
+	accessPolicy      string
+
+	injectionTemplatePath   string
+	injectionTemplateReload time.Duration
+
+	certReloadInterval time.Duration
+
+	bootstrapCerts       bool
+	certSecret           string
+	serviceName          string
+	webhookConfiguration string
+	namespace            string
+
+	clientCAFile       string
+	clientAllowedNames string
+
+	allowedNamespaces string
+	deniedNamespaces  string
+	namespaceSelector string
 )
 
 func init() {
@@ -45,8 +80,68 @@ func init() {
 		"File containing the default x509 private key matching --tls-cert-file.")
 	flag.IntVar(&port, "port", 443,
 		"Secure port that the webhook listens on")
+	flag.DurationVar(&certReloadInterval, "tls-reload-interval", 10*time.Second,
+		"How often --tls-cert-file and --tls-private-key-file are checked for a rotated certificate.")
         flag.StringVar(&sidecarImage, "sidecar-image", "",
 		"Image to be used as the injected sidecar")
+	flag.StringVar(&allowedImages, "allowed-images", "",
+		"Comma separated list of images that the secrets.k8s.aws/image annotation of a pod or Namespace can select instead of --sidecar-image. Empty, the default, ignores the annotation.")
+	flag.StringVar(&logLevel, "log-level", "info",
+		"Log level, either info or debug. Request bodies are never logged.")
+	flag.BoolVar(&nativeSidecars, "native-sidecars", false,
+		"Inject the refresh sidecar as a native sidecar, i.e. an init container with restartPolicy Always. Requires Kubernetes 1.28 or later with the SidecarContainers feature enabled, which is the default from 1.29.")
+	flag.BoolVar(&warnOnly, "warn-only", false,
+		"Admit pods with invalid secret annotations and return the problems as warnings instead.")
+	flag.StringVar(&clusterRegion, "region", os.Getenv("AWS_REGION"),
+		"Region of the cluster. Pods whose secrets are in another region are admitted with a warning.")
+	flag.StringVar(&credentialsPolicy, "credentials-policy", credentialsWarn,
+		"What to do with pods that request secrets but whose service account has neither an IRSA role nor an EKS Pod Identity association: ignore, warn or deny.")
+	flag.StringVar(&accessPolicy, "access-policy", accessIgnore,
+		"What to do with pods that request secrets that no SecretAccessPolicy or ClusterSecretAccessPolicy allows for their service account: ignore, warn or deny.")
+	flag.StringVar(&injectionTemplatePath, "injection-template", "",
+		"File holding a Go template of the containers, volumes and mounts to inject, typically mounted from a ConfigMap. Replaces the built-in injection.")
+	flag.DurationVar(&injectionTemplateReload, "injection-template-reload", 10*time.Second,
+		"How often the injection template file is checked for changes.")
+	flag.StringVar(&cpuRequest, "cpu-request", "10m",
+		"CPU request of the injected containers. Empty for none.")
+	flag.StringVar(&memoryRequest, "memory-request", "32Mi",
+		"Memory request of the injected containers. Empty for none.")
+	flag.StringVar(&cpuLimit, "cpu-limit", "",
+		"CPU limit of the injected containers. Empty for none.")
+	flag.StringVar(&memoryLimit, "memory-limit", "64Mi",
+		"Memory limit of the injected containers. Empty for none.")
+	flag.StringVar(&imagePullPolicy, "image-pull-policy", string(corev1.PullAlways),
+		"Pull policy of the injected containers: Always, IfNotPresent or Never.")
+	flag.StringVar(&imagePullSecrets, "image-pull-secrets", "",
+		"Comma separated list of image pull secrets added to pods for the injected image.")
+	flag.BoolVar(&hardenContainers, "harden-containers", true,
+		"Run the injected containers as a non-root user with a read-only root filesystem, no capabilities and the RuntimeDefault seccomp profile.")
+	flag.IntVar(&healthPort, "health-port", 8089,
+		"Port the refresh sidecar serves its probes on, unless the pod sets the secrets.k8s.aws/health-port annotation. Pods whose containers already use it are rejected.")
+	flag.StringVar(&initContainerPosition, "init-container-position", positionFirst,
+		"Whether the injected init containers run first or last among the init containers of the pod, e.g. after those added by a service mesh webhook.")
+	flag.BoolVar(&bootstrapCerts, "bootstrap-certs", false,
+		"Generate the CA and serving certificate, store them in --cert-secret, rotate them before they expire and patch the caBundle of --webhook-configuration. Replaces --tls-cert-file and --tls-private-key-file.")
+	flag.StringVar(&certSecret, "cert-secret", "secret-inject-tls",
+		"Secret holding the bootstrapped certificates. Also the name of the Lease used to elect the replica that manages them.")
+	flag.StringVar(&serviceName, "service-name", "secret-inject",
+		"Service of the webhook, which the bootstrapped serving certificate is issued for.")
+	flag.StringVar(&webhookConfiguration, "webhook-configuration", "aws-secret-inject",
+		"Mutating and validating webhook configurations whose caBundle is patched with the bootstrapped CA.")
+	flag.StringVar(&namespace, "namespace", os.Getenv("POD_NAMESPACE"),
+		"Namespace of the webhook, for --bootstrap-certs.")
+	flag.StringVar(&clientCAFile, "client-ca-file", "",
+		"File containing the CA bundle that issues the client certificate of the API server. When set, the admission endpoints reject callers without a client certificate issued by it. The file is checked for changes every --tls-reload-interval.")
+	flag.StringVar(&clientAllowedNames, "client-allowed-names", "",
+		"Comma separated list of the subject common names or SANs of the client certificates allowed to call the admission endpoints. Empty to allow any certificate issued by --client-ca-file.")
+	flag.StringVar(&allowedNamespaces, "allowed-namespaces", "",
+		"Comma separated list of the namespaces whose pods secrets are injected into. Empty for all namespaces.")
+	flag.StringVar(&deniedNamespaces, "denied-namespaces", "",
+		"Comma separated list of the namespaces whose pods secrets are never injected into.")
+	flag.StringVar(&namespaceSelector, "namespace-selector", "",
+		"Label selector of the namespaces whose pods secrets are injected into, e.g. secrets.k8s.aws/injection=enabled. Empty for all namespaces.")
+	flag.BoolVar(&useNamespaceDefaults, "namespace-defaults", false,
+		"Use the secrets.k8s.aws/ annotations of the namespace of a pod, such as mount-path, mode or image, as defaults for the annotations the pod does not set.")
 
 }
 
@@ -90,17 +185,18 @@ func serve(w http.ResponseWriter, r *http.Request, admit admitHandler) {
 	// verify the content type is accurate
 	contentType := r.Header.Get("Content-Type")
 	if contentType != "application/json" {
-		klog.Errorf("contentType=%s, expect application/json", contentType)
+		log.error("unexpected content type", fields{"content_type": contentType})
+		decodeFailures.WithLabelValues(r.URL.Path).Inc()
 		return
 	}
 
-	klog.Info(fmt.Sprintf("handling request: %s", body))
-
+	start := time.Now()
 	deserializer := codecs.UniversalDeserializer()
 	obj, gvk, err := deserializer.Decode(body, nil, nil)
 	if err != nil {
 		msg := fmt.Sprintf("Request could not be decoded: %v", err)
-		klog.Error(msg)
+		log.error("request could not be decoded", fields{fieldError: err})
+		decodeFailures.WithLabelValues(r.URL.Path).Inc()
 		http.Error(w, msg, http.StatusBadRequest)
 		return
 	}
@@ -110,74 +206,160 @@ func serve(w http.ResponseWriter, r *http.Request, admit admitHandler) {
 	case v1beta1.SchemeGroupVersion.WithKind("AdmissionReview"):
 		requestedAdmissionReview, ok := obj.(*v1beta1.AdmissionReview)
 		if !ok {
-			klog.Errorf("Expected v1beta1.AdmissionReview but got: %T", obj)
+			log.error("unexpected object type", fields{"type": fmt.Sprintf("%T", obj)})
 			return
 		}
+		log.info("handling request", requestFields(requestedAdmissionReview.Request.UID, requestedAdmissionReview.Request.Namespace, requestedAdmissionReview.Request.Name, string(requestedAdmissionReview.Request.Operation)))
 		responseAdmissionReview := &v1beta1.AdmissionReview{}
 		responseAdmissionReview.SetGroupVersionKind(*gvk)
 		responseAdmissionReview.Response = admit.v1beta1(*requestedAdmissionReview)
 		responseAdmissionReview.Response.UID = requestedAdmissionReview.Request.UID
+		resp := responseAdmissionReview.Response
+		observeAdmission(r.URL.Path, "v1beta1", string(requestedAdmissionReview.Request.Operation), start, resp.Allowed, resp.Patch, resp.Result)
 		responseObj = responseAdmissionReview
 	case v1.SchemeGroupVersion.WithKind("AdmissionReview"):
 		requestedAdmissionReview, ok := obj.(*v1.AdmissionReview)
 		if !ok {
-			klog.Errorf("Expected v1.AdmissionReview but got: %T", obj)
+			log.error("unexpected object type", fields{"type": fmt.Sprintf("%T", obj)})
 			return
 		}
+		log.info("handling request", requestFields(requestedAdmissionReview.Request.UID, requestedAdmissionReview.Request.Namespace, requestedAdmissionReview.Request.Name, string(requestedAdmissionReview.Request.Operation)))
 		responseAdmissionReview := &v1.AdmissionReview{}
 		responseAdmissionReview.SetGroupVersionKind(*gvk)
 		responseAdmissionReview.Response = admit.v1(*requestedAdmissionReview)
 		responseAdmissionReview.Response.UID = requestedAdmissionReview.Request.UID
+		resp := responseAdmissionReview.Response
+		observeAdmission(r.URL.Path, "v1", string(requestedAdmissionReview.Request.Operation), start, resp.Allowed, resp.Patch, resp.Result)
 		responseObj = responseAdmissionReview
 	default:
 		msg := fmt.Sprintf("Unsupported group version kind: %v", gvk)
-		klog.Error(msg)
+		log.error("unsupported group version kind", fields{"gvk": gvk.String()})
+		decodeFailures.WithLabelValues(r.URL.Path).Inc()
 		http.Error(w, msg, http.StatusBadRequest)
 		return
 	}
 
-	klog.V(2).Info(fmt.Sprintf("sending response: %v", responseObj))
 	respBytes, err := json.Marshal(responseObj)
 	if err != nil {
-		klog.Error(err)
+		log.error("unable to encode response", fields{fieldError: err})
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	if _, err := w.Write(respBytes); err != nil {
-		klog.Error(err)
+		log.error("unable to write response", fields{fieldError: err})
 	}
 }
 
+// requestFields returns the fields that identify an admission request in the
+// logs. Only metadata is included; the object under review never is.
+func requestFields(uid types.UID, namespace, name, operation string) fields {
+	return fields{fieldUID: uid, fieldNamespace: namespace, fieldPod: name, "operation": operation}
+}
 
 func serveMutatePods(w http.ResponseWriter, r *http.Request) {
 	serve(w, r, newDelegateToV1AdmitHandler(mutatePods))
 }
 
-func serveMutatePodsSidecar(w http.ResponseWriter, r *http.Request) {
-	serve(w, r, newDelegateToV1AdmitHandler(mutatePodsSidecar))
+func serveMutateWorkloads(w http.ResponseWriter, r *http.Request) {
+	serve(w, r, newDelegateToV1AdmitHandler(mutateWorkloads))
 }
 
+func serveValidatePods(w http.ResponseWriter, r *http.Request) {
+	serve(w, r, newDelegateToV1AdmitHandler(validatePods))
+}
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "inject" {
+		os.Exit(runInject(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+	}
 
-	loggingFlags := &flag.FlagSet{}
-	klog.InitFlags(loggingFlags)
 	flag.Parse()
+	log.verbose = logLevel == "debug"
+	if err := checkContainerFlags(); err != nil {
+		log.error("invalid flags", fields{fieldError: err})
+		os.Exit(1)
+	}
+
+	switch credentialsPolicy {
+	case credentialsIgnore:
+	case credentialsWarn, credentialsDeny:
+		if err := startServiceAccountInformer(make(chan struct{})); err != nil {
+			log.error("unable to watch service accounts, use --credentials-policy=ignore outside a cluster", fields{fieldError: err})
+			os.Exit(1)
+		}
+	default:
+		log.error("invalid flags", fields{fieldError: fmt.Errorf("--credentials-policy must be ignore, warn or deny")})
+		os.Exit(1)
+	}
+
+	switch accessPolicy {
+	case accessIgnore:
+	case accessWarn, accessDeny:
+		if err := startAccessPolicyInformer(make(chan struct{})); err != nil {
+			log.error("unable to watch secret access policies, install the CRDs or use --access-policy=ignore", fields{fieldError: err})
+			os.Exit(1)
+		}
+	default:
+		log.error("invalid flags", fields{fieldError: fmt.Errorf("--access-policy must be ignore, warn or deny")})
+		os.Exit(1)
+	}
+
+	p, err := newInjectionPolicy(allowedNamespaces, deniedNamespaces, namespaceSelector)
+	if err != nil {
+		log.error("invalid flags", fields{fieldError: err})
+		os.Exit(1)
+	}
+	policy = p
+	if namespaceSelector != "" || useNamespaceDefaults || accessPolicy != accessIgnore {
+		if err := startNamespaceInformer(make(chan struct{})); err != nil {
+			log.error("unable to watch namespaces", fields{fieldError: err})
+			os.Exit(1)
+		}
+	}
+
+	if injectionTemplatePath != "" {
+		t, err := loadTemplateFile(injectionTemplatePath)
+		if err != nil {
+			log.error("unable to load injection template", fields{fieldError: err})
+			os.Exit(1)
+		}
+		injectionTemplate = t
+		go t.watch(injectionTemplateReload, make(chan struct{}))
+	}
 
 	config := Config{
 		CertFile: certFile,
 		KeyFile:  keyFile,
 	}
+	if bootstrapCerts {
+		b, err := newBootstrapper(namespace, certSecret, serviceName, webhookConfiguration)
+		if err != nil {
+			log.error("unable to bootstrap webhook certificate", fields{fieldError: err})
+			os.Exit(1)
+		}
+		config.Bootstrap = b
+	}
+	if clientCAFile != "" {
+		a, err := loadClientAuth(clientCAFile, clientAllowedNames)
+		if err != nil {
+			log.error("unable to load client CA bundle", fields{fieldError: err})
+			os.Exit(1)
+		}
+		config.ClientAuth = a
+		go a.watch(certReloadInterval, make(chan struct{}))
+	}
 
-	http.HandleFunc("/mutating-pods", serveMutatePods)
-        http.HandleFunc("/mutating-pods-sidecar", serveMutatePodsSidecar)
+	http.HandleFunc("/mutating-pods", requireClient(config.ClientAuth, serveMutatePods))
+	http.HandleFunc("/mutating-workloads", requireClient(config.ClientAuth, serveMutateWorkloads))
+	http.HandleFunc("/validating-pods", requireClient(config.ClientAuth, serveValidatePods))
+	http.Handle("/metrics", metricsHandler())
 	http.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) { w.Write([]byte("ok")) })
 	server := &http.Server{
 		Addr:      fmt.Sprintf(":%d", port),
 		TLSConfig: configTLS(config),
 	}
-	err := server.ListenAndServeTLS("", "")
+	err = server.ListenAndServeTLS("", "")
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const metricsNamespace = "secret_inject"
+
+// metrics is the registry served on /metrics.
+var metrics = prometheus.NewRegistry()
+
+var certificateExpiry = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "certificate_expiry_timestamp_seconds",
+	Help:      "Expiry of the serving certificate in use, as a Unix timestamp.",
+})
+
+// Outcomes of an admission request.
+const (
+	outcomePatched = "patched"
+	outcomeSkipped = "skipped"
+	outcomeDenied  = "denied"
+	outcomeErrored = "errored"
+)
+
+var (
+	admissionRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "admission_requests_total",
+		Help:      "Admission requests handled, by endpoint, operation, AdmissionReview version and outcome: patched, skipped (allowed without a patch), denied or errored.",
+	}, []string{"endpoint", "operation", "version", "outcome"})
+	admissionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "admission_duration_seconds",
+		Help:      "Time taken to handle an admission request, from decoding the review to building the response.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"endpoint", "version"})
+	decodeFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "admission_decode_failures_total",
+		Help:      "Requests that were not a decodable AdmissionReview.",
+	}, []string{"endpoint"})
+	patchSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "admission_patch_size_bytes",
+		Help:      "Size of the JSON patches returned.",
+		Buckets:   prometheus.ExponentialBuckets(128, 2, 10),
+	}, []string{"endpoint"})
+)
+
+func init() {
+	metrics.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		certificateExpiry,
+		admissionRequests,
+		admissionDuration,
+		decodeFailures,
+		patchSize,
+	)
+}
+
+// observeAdmission records an admission request to endpoint that started at
+// start and was answered with the given response fields.
+func observeAdmission(endpoint, version, operation string, start time.Time, allowed bool, patch []byte, result *metav1.Status) {
+	outcome := outcomeSkipped
+	switch {
+	case allowed && len(patch) > 0:
+		outcome = outcomePatched
+		patchSize.WithLabelValues(endpoint).Observe(float64(len(patch)))
+	case allowed:
+	case result != nil && (result.Reason != "" || result.Code != 0):
+		// Deliberate rejections carry a reason or code; errors turned into
+		// a response by toV1AdmissionResponse only carry a message.
+		outcome = outcomeDenied
+	default:
+		outcome = outcomeErrored
+	}
+	admissionRequests.WithLabelValues(endpoint, operation, version, outcome).Inc()
+	admissionDuration.WithLabelValues(endpoint, version).Observe(time.Since(start).Seconds())
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metrics, promhttp.HandlerOpts{})
+}
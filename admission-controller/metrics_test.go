@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	v1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestAdmissionMetrics(t *testing.T) {
+	sidecarImage = "test-image"
+	post := func(handler http.HandlerFunc, path string, body []byte) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		handler(httptest.NewRecorder(), req)
+	}
+	reviewBody := func(review v1.AdmissionReview) []byte {
+		t.Helper()
+		review.TypeMeta = metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"}
+		body, err := json.Marshal(review)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+	count := func(endpoint, outcome string) float64 {
+		return testutil.ToFloat64(admissionRequests.WithLabelValues(endpoint, "CREATE", "v1", outcome))
+	}
+
+	before := map[string]float64{}
+	for _, outcome := range []string{outcomePatched, outcomeSkipped, outcomeDenied, outcomeErrored} {
+		before[outcome] = count("/mutating-pods", outcome)
+	}
+	beforeDenied := count("/validating-pods", outcomeDenied)
+	beforeDecode := testutil.ToFloat64(decodeFailures.WithLabelValues("/mutating-pods"))
+
+	post(serveMutatePods, "/mutating-pods", reviewBody(podReview(t, secretPod(map[string]string{annotationSecretArn: testArn}))))
+	post(serveMutatePods, "/mutating-pods", reviewBody(podReview(t, secretPod(nil))))
+	notAPod := podReview(t, secretPod(nil))
+	notAPod.Request.Resource.Resource = "services"
+	post(serveMutatePods, "/mutating-pods", reviewBody(notAPod))
+	post(serveValidatePods, "/validating-pods", reviewBody(podReview(t, secretPod(map[string]string{annotationSecretArn: "not-an-arn"}))))
+	post(serveMutatePods, "/mutating-pods", []byte("{"))
+
+	for outcome, want := range map[string]float64{outcomePatched: 1, outcomeSkipped: 1, outcomeErrored: 1, outcomeDenied: 0} {
+		if got := count("/mutating-pods", outcome) - before[outcome]; got != want {
+			t.Errorf("%s requests = %v, want %v", outcome, got, want)
+		}
+	}
+	if got := count("/validating-pods", outcomeDenied) - beforeDenied; got != 1 {
+		t.Errorf("denied validations = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(decodeFailures.WithLabelValues("/mutating-pods")) - beforeDecode; got != 1 {
+		t.Errorf("decode failures = %v, want 1", got)
+	}
+	if testutil.CollectAndCount(patchSize) == 0 {
+		t.Error("patch size was not observed")
+	}
+	if testutil.CollectAndCount(admissionDuration) == 0 {
+		t.Error("duration was not observed")
+	}
+}
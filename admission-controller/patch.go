@@ -0,0 +1,42 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+
+	"gomodules.xyz/jsonpatch/v2"
+)
+
+// createPatch returns the RFC 6902 JSON patch that turns original into
+// mutated. Both objects are serialized with the same types, so fields that
+// this webhook does not know about are never touched by the patch.
+func createPatch(original, mutated interface{}) ([]byte, error) {
+	before, err := json.Marshal(original)
+	if err != nil {
+		return nil, err
+	}
+	after, err := json.Marshal(mutated)
+	if err != nil {
+		return nil, err
+	}
+	ops, err := jsonpatch.CreatePatch(before, after)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(ops)
+}
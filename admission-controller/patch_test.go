@@ -20,161 +20,736 @@ import (
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 
 	jsonpatch "github.com/evanphx/json-patch"
+	v1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
 )
 
-func TestPatches(t *testing.T) {
+const testArn = "arn:aws:secretsmanager:us-east-1:123456789012:secret:db-AbCdEf"
+
+func podReview(t *testing.T, pod *corev1.Pod) v1.AdmissionReview {
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v1.AdmissionReview{
+		Request: &v1.AdmissionRequest{
+			UID:       "uid",
+			Namespace: pod.Namespace,
+			Operation: v1.Create,
+			Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	}
+}
+
+// admit runs the pod through admit and returns the pod with the returned
+// patch applied.
+func admit(t *testing.T, admit admitv1Func, pod *corev1.Pod) *corev1.Pod {
+	out, err := admitPod(admit, podReview(t, pod))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// admitPod is admit for use outside the test goroutine.
+func admitPod(admit admitv1Func, review v1.AdmissionReview) (*corev1.Pod, error) {
+	resp := admit(review)
+	if resp == nil || !resp.Allowed {
+		return nil, fmt.Errorf("pod was not allowed: %#v", resp)
+	}
+	out := &corev1.Pod{}
+	if resp.Patch == nil {
+		return out, json.Unmarshal(review.Request.Object.Raw, out)
+	}
+	if resp.PatchType == nil || *resp.PatchType != v1.PatchTypeJSONPatch {
+		return nil, fmt.Errorf("unexpected patch type %v", resp.PatchType)
+	}
+	patch, err := jsonpatch.DecodePatch(resp.Patch)
+	if err != nil {
+		return nil, fmt.Errorf("invalid patch %s: %v", resp.Patch, err)
+	}
+	patched, err := patch.Apply(review.Request.Object.Raw)
+	if err != nil {
+		return nil, fmt.Errorf("unable to apply patch %s: %v", resp.Patch, err)
+	}
+	return out, json.Unmarshal(patched, out)
+}
+
+func secretPod(annotations map[string]string, initContainers ...corev1.Container) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", Annotations: annotations},
+		Spec: corev1.PodSpec{
+			InitContainers: initContainers,
+			Containers: []corev1.Container{
+				{Name: "app", Image: "app"},
+				{Name: "proxy", Image: "proxy", VolumeMounts: []corev1.VolumeMount{{Name: "config", MountPath: "/etc/proxy"}}},
+			},
+			Volumes: []corev1.Volume{{Name: "config"}},
+		},
+	}
+}
+
+func TestMutatePods(t *testing.T) {
 	sidecarImage = "test-image"
 	testCases := []struct {
-		patch    string
-		initial  interface{}
-		expected interface{}
-		toTest   interface{}
+		name           string
+		annotations    map[string]string
+		initContainers []corev1.Container
+		mountPath      string
+		filename       string
+		initCount      int
 	}{
 		{
-			patch: configMapPatch1,
-			initial: corev1.ConfigMap{
-				Data: map[string]string{
-					"mutation-start": "yes",
-				},
-			},
-			expected: &corev1.ConfigMap{
-				Data: map[string]string{
-					"mutation-start":   "yes",
-					"mutation-stage-1": "yes",
-				},
-			},
-		},
-		{
-			patch: configMapPatch2,
-			initial: corev1.ConfigMap{
-				Data: map[string]string{
-					"mutation-start": "yes",
-				},
-			},
-			expected: &corev1.ConfigMap{
-				Data: map[string]string{
-					"mutation-start":   "yes",
-					"mutation-stage-2": "yes",
-				},
-			},
+			name:        "defaults",
+			annotations: map[string]string{annotationSecretArn: testArn},
+			mountPath:   defaultMountPath,
+			initCount:   1,
 		},
-
 		{
-			patch: podsInitContainerPatch,
-			initial: corev1.Pod{
-				Spec: corev1.PodSpec{
-					InitContainers: []corev1.Container{},
-				},
-			},
-			expected: &corev1.Pod{
-				Spec: corev1.PodSpec{
-					InitContainers: []corev1.Container{
-						{
-							Image:     "webhook-added-image",
-							Name:      "webhook-added-init-container",
-							Resources: corev1.ResourceRequirements{},
-						},
-					},
-				},
-			},
+			name:           "existing init containers",
+			annotations:    map[string]string{annotationSecretArn: testArn},
+			initContainers: []corev1.Container{{Name: "migrate", Image: "migrate"}},
+			mountPath:      defaultMountPath,
+			initCount:      2,
 		},
 		{
-			patch: fmt.Sprintf(podsSidecarPatch, sidecarImage),
-			initial: corev1.Pod{
-				Spec: corev1.PodSpec{
-					Containers: []corev1.Container{
-						{
-							Image:     "image1",
-							Name:      "container1",
-							Resources: corev1.ResourceRequirements{},
-						},
-					},
-				},
-			},
-			expected: &corev1.Pod{
-				Spec: corev1.PodSpec{
-					Containers: []corev1.Container{
-						{
-							Image:     "image1",
-							Name:      "container1",
-							Resources: corev1.ResourceRequirements{},
-						},
-						{
-							Image:     sidecarImage,
-							Name:      "webhook-added-sidecar",
-							Resources: corev1.ResourceRequirements{},
-						},
-					},
-				},
+			name: "annotations with quotes and escapes",
+			annotations: map[string]string{
+				annotationSecretArn:      testArn,
+				annotationMountPath:      `/var/"secrets"\x`,
+				annotationSecretFilename: "db/\"creds\"\n{\"op\":\"remove\"}",
 			},
+			mountPath: `/var/"secrets"\x`,
+			filename:  "db/\"creds\"\n{\"op\":\"remove\"}",
+			initCount: 1,
 		},
 	}
-	for _, testcase := range testCases {
-		objJS, err := json.Marshal(testcase.initial)
-		if err != nil {
-			t.Fatal(err)
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := admit(t, mutatePods, secretPod(tc.annotations, tc.initContainers...))
+
+			if len(pod.Spec.InitContainers) != tc.initCount {
+				t.Fatalf("got %d init containers, want %d", len(pod.Spec.InitContainers), tc.initCount)
+			}
+			init := pod.Spec.InitContainers[0]
+			if init.Name != initContainerName || init.Image != "test-image" {
+				t.Errorf("unexpected init container %s/%s", init.Name, init.Image)
+			}
+			for i, c := range tc.initContainers {
+				if !reflect.DeepEqual(pod.Spec.InitContainers[i+1], c) {
+					t.Errorf("existing init container %s was modified", c.Name)
+				}
+			}
+			env := map[string]corev1.EnvVar{}
+			for _, e := range init.Env {
+				env[e.Name] = e
+			}
+			if env["SECRET_ARN"].ValueFrom == nil || env["SECRET_ARN"].ValueFrom.FieldRef.FieldPath != "metadata.annotations['secrets.k8s.aws/secret-arn']" {
+				t.Errorf("unexpected SECRET_ARN %#v", env["SECRET_ARN"])
+			}
+			if e, ok := env["SECRET_FILENAME"]; ok != (tc.filename != "") || e.Value != tc.filename {
+				t.Errorf("SECRET_FILENAME = %q, want %q", e.Value, tc.filename)
+			}
+
+			if len(pod.Spec.Volumes) != 2 || pod.Spec.Volumes[1].Name != secretVolumeName ||
+				pod.Spec.Volumes[1].EmptyDir == nil || pod.Spec.Volumes[1].EmptyDir.Medium != corev1.StorageMediumMemory {
+				t.Errorf("unexpected volumes %#v", pod.Spec.Volumes)
+			}
+			for _, c := range pod.Spec.Containers {
+				last := c.VolumeMounts[len(c.VolumeMounts)-1]
+				if last.Name != secretVolumeName || last.MountPath != tc.mountPath {
+					t.Errorf("container %s: unexpected mount %#v", c.Name, last)
+				}
+			}
+			if pod.Spec.Containers[1].VolumeMounts[0].Name != "config" {
+				t.Errorf("existing volume mount was modified: %#v", pod.Spec.Containers[1].VolumeMounts)
+			}
+		})
+	}
+}
+
+func TestMutatePodsSkipsPods(t *testing.T) {
+	for name, pod := range map[string]*corev1.Pod{
+		"no annotation":    secretPod(nil),
+		"already injected": secretPod(map[string]string{annotationSecretArn: testArn}, corev1.Container{Name: initContainerName}),
+	} {
+		resp := mutatePods(podReview(t, pod))
+		if !resp.Allowed || resp.Patch != nil {
+			t.Errorf("%s: expected the pod to be allowed without a patch, got %#v", name, resp)
+		}
+	}
+}
+
+func TestMutatePodsMultipleSecrets(t *testing.T) {
+	sidecarImage = "test-image"
+	const apiArn = "arn:aws:secretsmanager:us-east-1:123456789012:secret:api-AbCdEf"
+	pod := admit(t, mutatePods, secretPod(map[string]string{
+		annotationSecretArn:                  testArn,
+		annotationSecretArn + ".api":         apiArn,
+		annotationSecretFilename + ".api":    "key",
+		annotationSecretArn + ".db":          testArn,
+		annotationMountPath + ".db":          "/var/db",
+		annotationSecretArn + ".Not_A_Label": apiArn,
+	}))
+
+	env := map[string]corev1.EnvVar{}
+	for _, e := range pod.Spec.InitContainers[0].Env {
+		env[e.Name] = e
+	}
+	if env["SECRET_ARN"].ValueFrom == nil {
+		t.Errorf("unexpected SECRET_ARN %#v", env["SECRET_ARN"])
+	}
+	files := map[string]string{}
+	if err := json.Unmarshal([]byte(env["SECRET_FILES"].Value), &files); err != nil {
+		t.Fatalf("invalid SECRET_FILES %q: %v", env["SECRET_FILES"].Value, err)
+	}
+	if want := map[string]string{"/api/key": apiArn, "/db/secret": testArn}; !reflect.DeepEqual(files, want) {
+		t.Errorf("SECRET_FILES = %v, want %v", files, want)
+	}
+
+	want := []corev1.VolumeMount{
+		{Name: secretVolumeName, MountPath: defaultMountPath},
+		{Name: secretVolumeName, MountPath: "/tmp/api", SubPath: "api"},
+		{Name: secretVolumeName, MountPath: "/var/db", SubPath: "db"},
+	}
+	if got := pod.Spec.Containers[0].VolumeMounts; !reflect.DeepEqual(got, want) {
+		t.Errorf("got mounts %#v, want %#v", got, want)
+	}
+}
+
+func TestMutatePodsNamedSecretsOnly(t *testing.T) {
+	sidecarImage = "test-image"
+	pod := admit(t, mutatePods, secretPod(map[string]string{annotationSecretArn + ".db": testArn}))
+	if len(pod.Spec.InitContainers) != 1 {
+		t.Fatalf("got %d init containers, want 1", len(pod.Spec.InitContainers))
+	}
+	for _, e := range pod.Spec.InitContainers[0].Env {
+		if e.Name == "SECRET_ARN" {
+			t.Errorf("unexpected SECRET_ARN for a pod without the unindexed annotation")
 		}
-		patchObj, err := jsonpatch.DecodePatch([]byte(testcase.patch))
-		if err != nil {
-			t.Fatal(err)
+	}
+}
+
+func TestMutatePodsContainers(t *testing.T) {
+	sidecarImage = "test-image"
+	pod := admit(t, mutatePods, secretPod(map[string]string{
+		annotationSecretArn:         testArn,
+		annotationSecretArn + ".db": testArn,
+		annotationMountPath + ".db": "/var/db",
+		annotationContainers:        " app:/etc/secrets , migrate,missing",
+	}, corev1.Container{Name: "migrate", Image: "migrate"}))
+
+	mounts := func(containers []corev1.Container, name string) []corev1.VolumeMount {
+		for _, c := range containers {
+			if c.Name == name {
+				var secretMounts []corev1.VolumeMount
+				for _, m := range c.VolumeMounts {
+					if m.Name == secretVolumeName {
+						secretMounts = append(secretMounts, m)
+					}
+				}
+				return secretMounts
+			}
+		}
+		t.Fatalf("container %s not found", name)
+		return nil
+	}
+	for _, tc := range []struct {
+		containers []corev1.Container
+		name       string
+		want       []corev1.VolumeMount
+	}{
+		{pod.Spec.Containers, "app", []corev1.VolumeMount{
+			{Name: secretVolumeName, MountPath: "/etc/secrets"},
+			{Name: secretVolumeName, MountPath: "/var/db", SubPath: "db"},
+		}},
+		{pod.Spec.InitContainers, "migrate", []corev1.VolumeMount{
+			{Name: secretVolumeName, MountPath: defaultMountPath},
+			{Name: secretVolumeName, MountPath: "/var/db", SubPath: "db"},
+		}},
+		{pod.Spec.Containers, "proxy", nil},
+	} {
+		if got := mounts(tc.containers, tc.name); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("container %s: got mounts %#v, want %#v", tc.name, got, tc.want)
 		}
+	}
+	if got := mounts(pod.Spec.InitContainers, initContainerName); len(got) != 1 || got[0].MountPath != "/tmp" {
+		t.Errorf("unexpected init container mounts %#v", got)
+	}
+}
 
-		patchedJS, err := patchObj.Apply(objJS)
-		if err != nil {
-			t.Fatal(err)
+func TestMutatePodsRefreshSidecar(t *testing.T) {
+	sidecarImage = "test-image"
+	defer func() { nativeSidecars = false }()
+	annotations := map[string]string{
+		annotationSecretArn:       testArn,
+		annotationMode:            modeSidecar,
+		annotationRefreshInterval: "1m",
+	}
+
+	checkSidecar := func(t *testing.T, c corev1.Container) {
+		env := map[string]string{}
+		for _, e := range c.Env {
+			env[e.Name] = e.Value
+		}
+		if env["REFRESH_INTERVAL"] != "1m" || env["HEALTH_ADDR"] != ":8089" {
+			t.Errorf("unexpected sidecar env %v", env)
+		}
+		if c.ReadinessProbe == nil || c.LivenessProbe == nil || c.LivenessProbe.HTTPGet.Path != "/healthz" {
+			t.Errorf("sidecar is missing probes")
 		}
-		objType := reflect.TypeOf(testcase.initial)
-		objTest := reflect.New(objType).Interface()
-		err = json.Unmarshal(patchedJS, objTest)
-		if err != nil {
-			t.Fatal(err)
+		if c.Resources.Limits.Memory().IsZero() {
+			t.Errorf("sidecar has no memory limit")
 		}
-		if !reflect.DeepEqual(objTest, testcase.expected) {
-			t.Errorf("\nexpected %#v\n, got %#v", testcase.expected, objTest)
+		if len(c.VolumeMounts) != 1 || c.VolumeMounts[0].Name != secretVolumeName {
+			t.Errorf("unexpected sidecar mounts %#v", c.VolumeMounts)
 		}
 	}
 
+	t.Run("regular sidecar", func(t *testing.T) {
+		nativeSidecars = false
+		pod := admit(t, mutatePods, secretPod(annotations))
+		if len(pod.Spec.InitContainers) != 1 || pod.Spec.InitContainers[0].Name != initContainerName {
+			t.Fatalf("unexpected init containers %#v", pod.Spec.InitContainers)
+		}
+		if len(pod.Spec.Containers) != 3 {
+			t.Fatalf("got %d containers, want 3", len(pod.Spec.Containers))
+		}
+		sidecar := pod.Spec.Containers[2]
+		if sidecar.Name != refreshContainerName || sidecar.RestartPolicy != nil {
+			t.Errorf("unexpected sidecar %#v", sidecar)
+		}
+		checkSidecar(t, sidecar)
+	})
+
+	t.Run("native sidecar", func(t *testing.T) {
+		nativeSidecars = true
+		pod := admit(t, mutatePods, secretPod(annotations, corev1.Container{Name: "migrate", Image: "migrate"}))
+		if len(pod.Spec.Containers) != 2 {
+			t.Fatalf("got %d containers, want 2", len(pod.Spec.Containers))
+		}
+		if len(pod.Spec.InitContainers) != 2 || pod.Spec.InitContainers[1].Name != "migrate" {
+			t.Fatalf("unexpected init containers %#v", pod.Spec.InitContainers)
+		}
+		sidecar := pod.Spec.InitContainers[0]
+		if sidecar.Name != refreshContainerName || sidecar.RestartPolicy == nil || *sidecar.RestartPolicy != corev1.ContainerRestartPolicyAlways {
+			t.Errorf("unexpected sidecar %#v", sidecar)
+		}
+		if sidecar.StartupProbe == nil || sidecar.StartupProbe.HTTPGet.Path != "/readyz" {
+			t.Errorf("native sidecar has no startup probe")
+		}
+		checkSidecar(t, sidecar)
+
+		resp := mutatePods(podReview(t, pod))
+		if !resp.Allowed || resp.Patch != nil {
+			t.Errorf("expected an injected pod to be left alone, got %#v", resp)
+		}
+	})
 }
 
-func TestJSONPatchForUnstructured(t *testing.T) {
-	cr := &unstructured.Unstructured{
-		Object: map[string]interface{}{
-			"kind":       "Something",
-			"apiVersion": "somegroup/v1",
-			"data": map[string]interface{}{
-				"mutation-start": "yes",
-			},
+func TestMutatePodsContainerSettings(t *testing.T) {
+	sidecarImage = "test-image"
+	pod := secretPod(map[string]string{
+		annotationSecretArn:        testArn,
+		annotationCPULimit:         "100m",
+		annotationMemoryRequest:    "not a quantity",
+		annotationImagePullPolicy:  "IfNotPresent",
+		annotationImagePullSecrets: "ecr, registry",
+	})
+	pod.Spec.ImagePullSecrets = []corev1.LocalObjectReference{{Name: "registry"}}
+	pod = admit(t, mutatePods, pod)
+
+	c := pod.Spec.InitContainers[0]
+	want := corev1.ResourceRequirements{
+		Requests: corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse(cpuRequest),
+			corev1.ResourceMemory: resource.MustParse(memoryRequest),
+		},
+		Limits: corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse("100m"),
+			corev1.ResourceMemory: resource.MustParse(memoryLimit),
 		},
 	}
-	crJS, err := json.Marshal(cr)
-	if err != nil {
-		t.Fatal(err)
+	if !apiequality.Semantic.DeepEqual(c.Resources, want) {
+		t.Errorf("got resources %#v, want %#v", c.Resources, want)
+	}
+	if c.ImagePullPolicy != corev1.PullIfNotPresent {
+		t.Errorf("ImagePullPolicy = %s, want IfNotPresent", c.ImagePullPolicy)
+	}
+	if want := []corev1.LocalObjectReference{{Name: "registry"}, {Name: "ecr"}}; !reflect.DeepEqual(pod.Spec.ImagePullSecrets, want) {
+		t.Errorf("got image pull secrets %v, want %v", pod.Spec.ImagePullSecrets, want)
 	}
 
-	patchObj, err := jsonpatch.DecodePatch([]byte(configMapPatch1))
-	if err != nil {
-		t.Fatal(err)
+	sc := c.SecurityContext
+	if sc == nil || !*sc.RunAsNonRoot || *sc.RunAsUser == 0 || !*sc.ReadOnlyRootFilesystem || *sc.AllowPrivilegeEscalation ||
+		!reflect.DeepEqual(sc.Capabilities.Drop, []corev1.Capability{"ALL"}) || sc.SeccompProfile.Type != corev1.SeccompProfileTypeRuntimeDefault {
+		t.Errorf("injected container is not hardened: %#v", sc)
 	}
-	patchedJS, err := patchObj.Apply(crJS)
-	if err != nil {
-		t.Fatal(err)
+}
+
+// TestMutatePodsImageAnnotation checks that pods can only select the images
+// of --allowed-images, since the injected containers receive their
+// credentials.
+func TestMutatePodsImageAnnotation(t *testing.T) {
+	sidecarImage = "test-image"
+	defer func() { allowedImages = "" }()
+	annotations := map[string]string{
+		annotationSecretArn: testArn,
+		annotationImage:     "registry.example.com/fetcher",
 	}
-	patchedObj := unstructured.Unstructured{}
-	err = json.Unmarshal(patchedJS, &patchedObj)
-	if err != nil {
-		t.Fatal(err)
+
+	pod := admit(t, mutatePods, secretPod(annotations))
+	if image := pod.Spec.InitContainers[0].Image; image != "test-image" {
+		t.Errorf("image = %q, want the annotation to be ignored without --allowed-images", image)
+	}
+	resp := validatePods(podReview(t, pod))
+	if resp.Allowed || !strings.Contains(resp.Result.Message, "is not one of the images allowed by --allowed-images") {
+		t.Errorf("expected the image annotation to be rejected, got %#v", resp.Result)
+	}
+
+	allowedImages = "other, registry.example.com/fetcher"
+	pod = admit(t, mutatePods, secretPod(annotations))
+	if image := pod.Spec.InitContainers[0].Image; image != "registry.example.com/fetcher" {
+		t.Errorf("image = %q, want the allowed image of the annotation", image)
+	}
+	if resp := validatePods(podReview(t, pod)); !resp.Allowed {
+		t.Errorf("expected an allowed image to be accepted, got %#v", resp.Result)
+	}
+}
+
+func TestCheckContainerFlags(t *testing.T) {
+	defer func(limit, policy string) { memoryLimit, imagePullPolicy = limit, policy }(memoryLimit, imagePullPolicy)
+	if err := checkContainerFlags(); err != nil {
+		t.Errorf("default flags are invalid: %v", err)
 	}
-	expectedData := map[string]interface{}{
-		"mutation-start":   "yes",
-		"mutation-stage-1": "yes",
+	memoryLimit = "lots"
+	if err := checkContainerFlags(); err == nil {
+		t.Error("expected an invalid memory limit to be rejected")
 	}
+	memoryLimit, imagePullPolicy = "", "Sometimes"
+	if err := checkContainerFlags(); err == nil {
+		t.Error("expected an invalid pull policy to be rejected")
+	}
+}
+
+// TestMutatePodsConcurrently checks that concurrent admissions do not share
+// state. Run with -race.
+func TestMutatePodsConcurrently(t *testing.T) {
+	sidecarImage = "test-image"
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		var init []corev1.Container
+		if i%2 == 0 {
+			init = append(init, corev1.Container{Name: "migrate", Image: "migrate"})
+		}
+		filename := fmt.Sprintf("secret-%d", i)
+		review := podReview(t, secretPod(map[string]string{annotationSecretArn: testArn, annotationSecretFilename: filename}, init...))
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			pod, err := admitPod(mutatePods, review)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if len(pod.Spec.InitContainers) != len(init)+1 {
+				t.Errorf("request %d: got %d init containers", i, len(pod.Spec.InitContainers))
+				return
+			}
+			for _, e := range pod.Spec.InitContainers[0].Env {
+				if e.Name == "SECRET_FILENAME" && e.Value != filename {
+					t.Errorf("request %d: SECRET_FILENAME = %q, want %q", i, e.Value, filename)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestMutatePodsVolumeNameConflict(t *testing.T) {
+	sidecarImage = "test-image"
+	pod := secretPod(map[string]string{annotationSecretArn: testArn})
+	pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{Name: secretVolumeName}, corev1.Volume{Name: secretVolumeName + "-2"})
+	pod = admit(t, mutatePods, pod)
+
+	const want = secretVolumeName + "-3"
+	if v := pod.Spec.Volumes[len(pod.Spec.Volumes)-1]; v.Name != want || v.EmptyDir == nil {
+		t.Errorf("unexpected secret volume %#v", v)
+	}
+	if m := pod.Spec.InitContainers[0].VolumeMounts; len(m) != 1 || m[0].Name != want {
+		t.Errorf("fetcher does not mount %s: %#v", want, m)
+	}
+	if m := pod.Spec.Containers[0].VolumeMounts; len(m) != 1 || m[0].Name != want {
+		t.Errorf("app does not mount %s: %#v", want, m)
+	}
+	if resp := validatePods(podReview(t, pod)); !resp.Allowed {
+		t.Errorf("mutated pod was rejected: %s", resp.Result.Message)
+	}
+}
+
+func TestMutatePodsMountPathConflict(t *testing.T) {
+	sidecarImage = "test-image"
+	resp := mutatePods(podReview(t, secretPod(map[string]string{annotationSecretArn: testArn, annotationMountPath: "/etc/proxy/"})))
+	if resp.Allowed || resp.Result == nil || resp.Result.Code != 422 {
+		t.Fatalf("expected the pod to be rejected, got %#v", resp)
+	}
+	if want := "conflicting secret mounts: container proxy already mounts volume config on /etc/proxy"; resp.Result.Message != want {
+		t.Errorf("message = %q, want %q", resp.Result.Message, want)
+	}
+}
+
+// TestMutatePodsReinvocation checks that the webhook can be reinvoked, as
+// with reinvocationPolicy IfNeeded, after another webhook added containers.
+func TestMutatePodsReinvocation(t *testing.T) {
+	sidecarImage = "test-image"
+	for _, mode := range []string{modeInit, modeSidecar} {
+		t.Run(mode, func(t *testing.T) {
+			pod := admit(t, mutatePods, secretPod(map[string]string{annotationSecretArn: testArn, annotationMode: mode}))
+			injected := pod.DeepCopy()
 
-	if !reflect.DeepEqual(patchedObj.Object["data"], expectedData) {
-		t.Errorf("\nexpected %#v\n, got %#v", expectedData, patchedObj.Object["data"])
+			// A service mesh injects its proxy and init container.
+			pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: "mesh-proxy", Image: "mesh"})
+			pod.Spec.InitContainers = append([]corev1.Container{{Name: "mesh-init", Image: "mesh"}}, pod.Spec.InitContainers...)
+			pod = admit(t, mutatePods, pod)
+
+			if !apiequality.Semantic.DeepEqual(pod.Spec.Volumes, injected.Spec.Volumes) {
+				t.Errorf("volumes were changed on reinvocation: %#v", pod.Spec.Volumes)
+			}
+			if len(pod.Spec.InitContainers) != len(injected.Spec.InitContainers)+1 {
+				t.Errorf("init containers were injected again: %d", len(pod.Spec.InitContainers))
+			}
+			for _, c := range pod.Spec.Containers {
+				n := 0
+				for _, m := range c.VolumeMounts {
+					if m.Name == secretVolumeName {
+						n++
+					}
+				}
+				if n != 1 {
+					t.Errorf("container %s mounts the secret volume %d times", c.Name, n)
+				}
+			}
+			if resp := mutatePods(podReview(t, pod)); !resp.Allowed || resp.Patch != nil {
+				t.Errorf("expected a third invocation to change nothing, got %#v", resp)
+			}
+		})
+	}
+}
+
+func TestMutatePodsInitContainerPosition(t *testing.T) {
+	sidecarImage = "test-image"
+	defer func() { initContainerPosition = positionFirst }()
+	initContainerPosition = positionLast
+	pod := admit(t, mutatePods, secretPod(map[string]string{annotationSecretArn: testArn}, corev1.Container{Name: "migrate", Image: "migrate"}))
+	if len(pod.Spec.InitContainers) != 2 || pod.Spec.InitContainers[1].Name != initContainerName {
+		t.Errorf("expected the fetcher to run last, got %#v", pod.Spec.InitContainers)
+	}
+}
+
+func TestMutatePodsCredentials(t *testing.T) {
+	sidecarImage = "test-image"
+	withCredentials := func(mode string, env []corev1.EnvVar, mount corev1.VolumeMount) *corev1.Pod {
+		pod := secretPod(map[string]string{annotationSecretArn: testArn, annotationMode: mode})
+		for i := range pod.Spec.Containers {
+			c := &pod.Spec.Containers[i]
+			c.Env = append([]corev1.EnvVar{{Name: "LOG_LEVEL", Value: "debug"}}, env...)
+			c.VolumeMounts = append(c.VolumeMounts, mount)
+		}
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{Name: mount.Name})
+		return pod
+	}
+	hasEnv := func(c corev1.Container, e corev1.EnvVar) bool {
+		for _, v := range c.Env {
+			if v == e {
+				return true
+			}
+		}
+		return false
+	}
+	testCases := []struct {
+		name  string
+		env   []corev1.EnvVar
+		mount corev1.VolumeMount
+	}{
+		{"irsa", []corev1.EnvVar{
+			{Name: "AWS_STS_REGIONAL_ENDPOINTS", Value: "regional"},
+			{Name: irsaRoleEnv, Value: "arn:aws:iam::123456789012:role/app"},
+			{Name: irsaTokenEnv, Value: "/var/run/secrets/eks.amazonaws.com/serviceaccount/token"},
+			{Name: "AWS_REGION", Value: "us-west-2"},
+			{Name: "AWS_DEFAULT_REGION", Value: "us-west-2"},
+		}, corev1.VolumeMount{Name: irsaVolume, MountPath: "/var/run/secrets/eks.amazonaws.com/serviceaccount", ReadOnly: true}},
+		{"pod identity", []corev1.EnvVar{
+			{Name: podIdentityEnv, Value: "http://169.254.170.23/v1/credentials"},
+			{Name: podIdentityTokenEnv, Value: "/var/run/secrets/pods.eks.amazonaws.com/serviceaccount/eks-pod-identity-token"},
+		}, corev1.VolumeMount{Name: podIdentityVolume, MountPath: "/var/run/secrets/pods.eks.amazonaws.com/serviceaccount", ReadOnly: true}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := admit(t, mutatePods, withCredentials(modeSidecar, tc.env, tc.mount))
+			for _, c := range append(pod.Spec.InitContainers, pod.Spec.Containers...) {
+				if c.Name != initContainerName && c.Name != refreshContainerName {
+					continue
+				}
+				for _, e := range tc.env {
+					if !hasEnv(c, e) {
+						t.Errorf("%s: missing credential env %s", c.Name, e.Name)
+					}
+				}
+				if hasEnv(c, corev1.EnvVar{Name: "LOG_LEVEL", Value: "debug"}) {
+					t.Errorf("%s: unrelated env copied", c.Name)
+				}
+				if m := c.VolumeMounts; len(m) != 2 || m[1] != tc.mount {
+					t.Errorf("%s: got mounts %v, want the token volume mounted", c.Name, m)
+				}
+			}
+
+			// The default template injects the same.
+			builtin := admit(t, mutatePods, withCredentials(modeInit, tc.env, tc.mount))
+			withTemplate(t, defaultTemplate)
+			templated := admit(t, mutatePods, withCredentials(modeInit, tc.env, tc.mount))
+			if !apiequality.Semantic.DeepEqual(builtin.Spec.InitContainers, templated.Spec.InitContainers) {
+				t.Errorf("default template differs from the built-in injection:\nbuilt-in: %#v\ntemplate: %#v", builtin.Spec.InitContainers, templated.Spec.InitContainers)
+			}
+		})
+	}
+
+	// Pods without credentials get none.
+	pod := admit(t, mutatePods, secretPod(map[string]string{annotationSecretArn: testArn}))
+	for _, e := range pod.Spec.InitContainers[0].Env {
+		if credentialEnv[e.Name] {
+			t.Errorf("unexpected credential env %s", e.Name)
+		}
+	}
+}
+
+// TestMutatePodsCredentialsReinvocation checks that the injected containers
+// get the credentials that EKS added to the pod after them when the webhook
+// is reinvoked.
+func TestMutatePodsCredentialsReinvocation(t *testing.T) {
+	sidecarImage = "test-image"
+	for _, mode := range []string{modeInit, modeSidecar} {
+		t.Run(mode, func(t *testing.T) {
+			pod := admit(t, mutatePods, secretPod(map[string]string{annotationSecretArn: testArn, annotationMode: mode}))
+
+			// EKS mutates the pod after this webhook, without giving the
+			// injected containers its credentials.
+			env := []corev1.EnvVar{
+				{Name: irsaRoleEnv, Value: "arn:aws:iam::123456789012:role/app"},
+				{Name: irsaTokenEnv, Value: "/var/run/secrets/eks.amazonaws.com/serviceaccount/token"},
+				{Name: "AWS_REGION", Value: "us-west-2"},
+			}
+			mount := corev1.VolumeMount{Name: irsaVolume, MountPath: "/var/run/secrets/eks.amazonaws.com/serviceaccount", ReadOnly: true}
+			for _, name := range []string{"app", "proxy"} {
+				for i := range pod.Spec.Containers {
+					if c := &pod.Spec.Containers[i]; c.Name == name {
+						c.Env = append(c.Env, env...)
+						c.VolumeMounts = append(c.VolumeMounts, mount)
+					}
+				}
+			}
+			pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{Name: irsaVolume})
+			volumes := len(pod.Spec.Volumes)
+			pod = admit(t, mutatePods, pod)
+
+			fetchers := 0
+			for _, c := range append(pod.Spec.InitContainers, pod.Spec.Containers...) {
+				if c.Name != initContainerName && c.Name != refreshContainerName {
+					continue
+				}
+				fetchers++
+				for _, e := range env {
+					if !hasEnv(c, e.Name) {
+						t.Errorf("%s: missing credential env %s", c.Name, e.Name)
+					}
+				}
+				if !mountsVolume(c, irsaVolume) {
+					t.Errorf("%s: token volume not mounted: %v", c.Name, c.VolumeMounts)
+				}
+			}
+			if fetchers == 0 {
+				t.Fatal("no fetcher container found")
+			}
+			if len(pod.Spec.Volumes) != volumes {
+				t.Errorf("volumes were changed on reinvocation: %#v", pod.Spec.Volumes)
+			}
+			if resp := mutatePods(podReview(t, pod)); !resp.Allowed || resp.Patch != nil {
+				t.Errorf("expected a third invocation to change nothing, got %#v", resp)
+			}
+		})
+	}
+}
+
+// TestMutatePodsServiceAccountCredentials checks that pods that EKS has not
+// mutated yet get the IRSA credentials of their ServiceAccount.
+func TestMutatePodsServiceAccountCredentials(t *testing.T) {
+	sidecarImage = "test-image"
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	indexer.Add(&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "irsa", Namespace: "default", Annotations: map[string]string{annotationRoleArn: "arn:aws:iam::123456789012:role/app"}}})
+	serviceAccounts = corelisters.NewServiceAccountLister(indexer)
+	defer func() { serviceAccounts, clusterRegion = nil, "" }()
+	clusterRegion = "us-east-1"
+
+	// The region of the application container does not make it a source of
+	// credentials, but is given to the fetcher.
+	pod := secretPod(map[string]string{annotationSecretArn: testArn})
+	pod.Spec.ServiceAccountName = "irsa"
+	pod.Spec.Containers[0].Env = []corev1.EnvVar{{Name: "AWS_REGION", Value: "eu-west-1"}}
+	pod = admit(t, mutatePods, pod)
+	init := pod.Spec.InitContainers[0]
+	for _, e := range []corev1.EnvVar{
+		{Name: irsaRoleEnv, Value: "arn:aws:iam::123456789012:role/app"},
+		{Name: irsaTokenEnv, Value: "/var/run/secrets/eks.amazonaws.com/serviceaccount/token"},
+		{Name: "AWS_REGION", Value: "eu-west-1"},
+	} {
+		found := false
+		for _, v := range init.Env {
+			found = found || v == e
+		}
+		if !found {
+			t.Errorf("missing credential env %v", e)
+		}
+	}
+	if want := (corev1.VolumeMount{Name: irsaVolume, MountPath: irsaTokenPath, ReadOnly: true}); init.VolumeMounts[len(init.VolumeMounts)-1] != want {
+		t.Errorf("got mounts %v, want the token volume mounted", init.VolumeMounts)
+	}
+	var token *corev1.Volume
+	for i := range pod.Spec.Volumes {
+		if pod.Spec.Volumes[i].Name == irsaVolume {
+			token = &pod.Spec.Volumes[i]
+		}
+	}
+	if token == nil || token.Projected == nil || token.Projected.Sources[0].ServiceAccountToken.Audience != irsaAudience {
+		t.Errorf("got token volume %#v, want a projected service account token", token)
+	}
+	for _, c := range pod.Spec.Containers {
+		if hasEnv(c, irsaRoleEnv) {
+			t.Errorf("%s: credentials added to an application container", c.Name)
+		}
+	}
+
+	// Without a region in the pod, the fetcher gets that of the cluster.
+	pod = secretPod(map[string]string{annotationSecretArn: testArn})
+	pod.Spec.ServiceAccountName = "irsa"
+	pod = admit(t, mutatePods, pod)
+	for _, name := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		found := false
+		for _, v := range pod.Spec.InitContainers[0].Env {
+			found = found || v == corev1.EnvVar{Name: name, Value: "us-east-1"}
+		}
+		if !found {
+			t.Errorf("missing region env %s", name)
+		}
 	}
 }
@@ -17,99 +17,379 @@ limitations under the License.
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"path"
+	"strconv"
 	"strings"
-        "strconv"
 
 	"k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/klog"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
+// Annotations read from the pod.
 const (
-	podsSidecarPatch string = `[
-		{"op":"add", "path":"/spec/containers/-","value":{"image":"%v","name":"webhook-added-sidecar","volumeMounts":[{"name":"vol","mountPath":"/tmp"}],"resources":{}}}
-	]` 
+	annotationSecretArn      = "secrets.k8s.aws/secret-arn"
+	annotationMountPath      = "secrets.k8s.aws/mount-path"
+	annotationSecretFilename = "secrets.k8s.aws/secret-filename"
+	annotationContainers     = "secrets.k8s.aws/containers"
+	// annotationMode selects how secrets are retrieved, either once by an
+	// init container (the default) or continuously by a sidecar.
+	annotationMode            = "secrets.k8s.aws/mode"
+	annotationRefreshInterval = "secrets.k8s.aws/refresh-interval"
+	// annotationHealthPort overrides --health-port for the pod.
+	annotationHealthPort = "secrets.k8s.aws/health-port"
 )
 
-var podsInitContainerPatch string = `[
-                 {"op":"add","path":"/spec/initContainers/0","value":{"image":"%v","name":"secrets-init-container","imagePullPolicy": "Always","volumeMounts":[{"name":"secret-vol","mountPath":"/tmp"}],"env":[{"name": "SECRET_ARN","valueFrom": {"fieldRef": {"fieldPath": "metadata.annotations['secrets.k8s.aws/secret-arn']"}}}`
+// Values of annotationMode.
+const (
+	modeInit    = "init"
+	modeSidecar = "sidecar"
+)
 
-func admitPods(ar v1.AdmissionReview) *v1.AdmissionResponse {
-	klog.V(2).Info("admitting pods")
-	podResource := metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}
-	if ar.Request.Resource != podResource {
-		err := fmt.Errorf("expect resource to be %s", podResource)
-		klog.Error(err)
-		return toV1AdmissionResponse(err)
+const (
+	initContainerName = "secrets-init-container"
+	secretVolumeName  = "secret-vol"
+	defaultMountPath  = "/tmp/"
+
+	refreshContainerName   = "secrets-refresh-sidecar"
+	defaultRefreshInterval = "5m"
+)
+
+// healthPort is where the refresh sidecar serves its probes, set by
+// --health-port.
+var healthPort int
+
+// Values of --init-container-position.
+const (
+	positionFirst = "first"
+	positionLast  = "last"
+)
+
+func mutatePods(ar v1.AdmissionReview) *v1.AdmissionResponse {
+	shouldPatchPod := func(pod *corev1.Pod) bool {
+		if len(secretRequests(pod.ObjectMeta.Annotations)) == 0 || injectedInTemplate(pod) {
+			return false
+		}
+		return !skipInjection(ar, pod)
 	}
+	return applyPodPatch(ar, shouldPatchPod, injectSecrets)
+}
 
-	raw := ar.Request.Object.Raw
-	pod := corev1.Pod{}
-	deserializer := codecs.UniversalDeserializer()
-	if _, _, err := deserializer.Decode(raw, nil, &pod); err != nil {
-		klog.Error(err)
-		return toV1AdmissionResponse(err)
+// mountConflictError reports volume mounts that would make the mutated pod
+// invalid.
+type mountConflictError struct {
+	conflicts []string
+}
+
+func (e *mountConflictError) Error() string {
+	return "conflicting secret mounts: " + strings.Join(e.conflicts, "; ")
+}
+
+// injectSecrets adds the containers that retrieve the requested secrets, the
+// in-memory volume they are written to, and mounts of that volume to the
+// containers of pod.
+//
+// In init mode the secrets are retrieved once by an init container. In
+// sidecar mode they are refreshed by a long-running container: a native
+// sidecar, i.e. an init container that is restarted for the life of the pod,
+// when nativeSidecars is set, and an init container followed by a regular
+// sidecar container otherwise.
+//
+// The secret volume is named secretVolumeName, or given a unique name when
+// the pod already has a volume of that name. Pods that the secrets were
+// already injected into, when the webhook is reinvoked after other webhooks
+// changed the pod, only get the secret volume mounted in the containers that
+// were added since, and the credentials that EKS added to the pod since.
+//
+// When an injection template is configured it replaces all of the above.
+func injectSecrets(pod *corev1.Pod) error {
+	if injectionTemplate != nil {
+		return injectFromTemplate(injectionTemplate.template(), pod)
 	}
-	reviewResponse := v1.AdmissionResponse{}
-	reviewResponse.Allowed = true
 
-	var msg string
-	if v, ok := pod.Labels["webhook-e2e-test"]; ok {
-		if v == "webhook-disallow" {
-			reviewResponse.Allowed = false
-			msg = msg + "the pod contains unwanted label; "
+	requests := secretRequests(pod.ObjectMeta.Annotations)
+	if volume, injected := injectedVolume(pod); injected {
+		addCredentials(pod)
+		if volume == "" {
+			return nil
 		}
-		if v == "wait-forever" {
-			reviewResponse.Allowed = false
-			msg = msg + "the pod response should not be sent; "
-			<-make(chan int) // Sleep forever - no one sends to this channel
+		return mountSecrets(pod, requests, volume)
+	}
+	volume := secretVolume(pod)
+	env := fetcherEnv(pod, requests)
+	if err := mountSecrets(pod, requests, volume); err != nil {
+		return err
+	}
+
+	var init []corev1.Container
+	if pod.ObjectMeta.Annotations[annotationMode] != modeSidecar {
+		init = append(init, fetcherContainer(pod, initContainerName, env, volume))
+	} else {
+		interval := pod.ObjectMeta.Annotations[annotationRefreshInterval]
+		if interval == "" {
+			interval = defaultRefreshInterval
+		}
+		sidecar := refreshContainer(pod, env, interval, volume)
+		if nativeSidecars {
+			always := corev1.ContainerRestartPolicyAlways
+			sidecar.RestartPolicy = &always
+			// Containers that come after a native sidecar are started
+			// once its startup probe succeeds, i.e. once the secrets
+			// have been written.
+			sidecar.StartupProbe = healthProbe("/readyz", podHealthPort(pod.ObjectMeta.Annotations))
+			init = append(init, sidecar)
+		} else {
+			init = append(init, fetcherContainer(pod, initContainerName, env, volume))
+			pod.Spec.Containers = append(pod.Spec.Containers, sidecar)
 		}
 	}
-	for _, container := range pod.Spec.Containers {
-		if strings.Contains(container.Name, "webhook-disallow") {
-			reviewResponse.Allowed = false
-			msg = msg + "the pod contains unwanted container name; "
+	addInitContainers(pod, init)
+	addImagePullSecrets(pod)
+
+	pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+		Name:         volume,
+		VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{Medium: corev1.StorageMediumMemory}},
+	})
+	addCredentials(pod)
+	return nil
+}
+
+// fetcherEnv returns the environment that selects the secrets requested by
+// pod in the fetcher, followed by the AWS credentials of the pod, if any.
+func fetcherEnv(pod *corev1.Pod, requests []secretRequest) []corev1.EnvVar {
+	var env []corev1.EnvVar
+	files := map[string]string{}
+	for _, r := range requests {
+		if r.name != "" {
+			files[r.volumePath()] = r.arn
+			continue
 		}
+		env = append(env, corev1.EnvVar{Name: "SECRET_ARN", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.annotations['" + annotationSecretArn + "']"}}})
 	}
-	if !reviewResponse.Allowed {
-		reviewResponse.Result = &metav1.Status{Message: strings.TrimSpace(msg)}
+	env = append(env,
+		corev1.EnvVar{Name: "POD_NAME", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"}}},
+		corev1.EnvVar{Name: "POD_NAMESPACE", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.namespace"}}},
+	)
+	if filename, ok := pod.ObjectMeta.Annotations[annotationSecretFilename]; ok {
+		env = append(env, corev1.EnvVar{Name: "SECRET_FILENAME", Value: filename})
 	}
-	return &reviewResponse
+	if len(files) > 0 {
+		// encoding/json sorts map keys, so the value is stable across
+		// admissions of the same pod.
+		value, _ := json.Marshal(files)
+		env = append(env, corev1.EnvVar{Name: "SECRET_FILES", Value: string(value)})
+	}
+	credentials, _ := podCredentials(pod)
+	return append(env, credentials...)
 }
 
-func mutatePods(ar v1.AdmissionReview) *v1.AdmissionResponse {
-	shouldPatchPod := func(pod *corev1.Pod) bool {
-               _, arn_ok :=  pod.ObjectMeta.Annotations["secrets.k8s.aws/secret-arn"]
-               if arn_ok == false {
-                  return false
-               }
-
-               if  len(pod.Spec.InitContainers) == 0 {
-                  podsInitContainerPatch  =  `[
-                  {"op":"add","path":"/spec/initContainers","value":[{"image":"%v","name":"secrets-init-container","imagePullPolicy": "Always","volumeMounts":[{"name":"secret-vol","mountPath":"/tmp"}],"env":[{"name": "SECRET_ARN","valueFrom": {"fieldRef": {"fieldPath": "metadata.annotations['secrets.k8s.aws/secret-arn']"}}}`
-            }
-               return !hasContainer(pod.Spec.InitContainers, "secrets-init-container")
-        }
-	return applyPodPatch(ar, shouldPatchPod, fmt.Sprintf(podsInitContainerPatch, sidecarImage))
-}
-
-func mutatePodsSidecar(ar v1.AdmissionReview) *v1.AdmissionResponse {
-	if sidecarImage == "" {
-		return &v1.AdmissionResponse{
-			Allowed: false,
-			Result: &metav1.Status{
-				Status:  "Failure",
-				Message: "No image specified by the sidecar-image parameter",
-				Code:    500,
-			},
+// addInitContainers adds init to the init containers of pod, before or after
+// the existing ones according to --init-container-position. Running first
+// lets the secrets be retrieved before, e.g., a service mesh redirects the
+// traffic of the pod to a proxy that is not running yet.
+func addInitContainers(pod *corev1.Pod, init []corev1.Container) {
+	if initContainerPosition == positionLast {
+		pod.Spec.InitContainers = append(pod.Spec.InitContainers, init...)
+		return
+	}
+	pod.Spec.InitContainers = append(init, pod.Spec.InitContainers...)
+}
+
+// secretVolume returns a name for the secret volume that pod does not use
+// yet: secretVolumeName, or that name followed by the first free number.
+func secretVolume(pod *corev1.Pod) string {
+	used := map[string]bool{}
+	for _, v := range pod.Spec.Volumes {
+		used[v.Name] = true
+	}
+	name := secretVolumeName
+	for i := 2; used[name]; i++ {
+		name = fmt.Sprintf("%s-%d", secretVolumeName, i)
+	}
+	return name
+}
+
+// injectedVolume reports whether the secrets were already injected into pod
+// and returns the name of the secret volume, which the fetcher mounts on
+// /tmp. The name is empty if it cannot be found.
+func injectedVolume(pod *corev1.Pod) (string, bool) {
+	injected := false
+	for _, containers := range [][]corev1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for _, c := range containers {
+			if c.Name != initContainerName && c.Name != refreshContainerName {
+				continue
+			}
+			injected = true
+			for _, m := range c.VolumeMounts {
+				if m.MountPath == "/tmp" {
+					return m.Name, true
+				}
+			}
 		}
 	}
-	shouldPatchPod := func(pod *corev1.Pod) bool {
-		return !hasContainer(pod.Spec.Containers, "webhook-added-sidecar")
+	return "", injected
+}
+
+// fetcherContainer returns a container that runs the fetcher with env and
+// writes to the secret volume, with the resources and pull policy selected
+// for pod and the credential token volumes of the pod mounted.
+func fetcherContainer(pod *corev1.Pod, name string, env []corev1.EnvVar, volume string) corev1.Container {
+	_, credentialMounts := podCredentials(pod)
+	return corev1.Container{
+		Image:           containerImage(pod.ObjectMeta.Annotations),
+		Name:            name,
+		ImagePullPolicy: containerPullPolicy(pod.ObjectMeta.Annotations),
+		VolumeMounts:    append([]corev1.VolumeMount{{Name: volume, MountPath: "/tmp"}}, credentialMounts...),
+		Env:             append([]corev1.EnvVar(nil), env...),
+		Resources:       containerResources(pod.ObjectMeta.Annotations),
+		SecurityContext: containerSecurityContext(),
+	}
+}
+
+// refreshContainer returns a container that runs the fetcher with env and
+// refreshes the secrets at interval, with probes on its health endpoint.
+func refreshContainer(pod *corev1.Pod, env []corev1.EnvVar, interval, volume string) corev1.Container {
+	port := podHealthPort(pod.ObjectMeta.Annotations)
+	c := fetcherContainer(pod, refreshContainerName, env, volume)
+	c.Env = append(c.Env,
+		corev1.EnvVar{Name: "REFRESH_INTERVAL", Value: interval},
+		corev1.EnvVar{Name: "HEALTH_ADDR", Value: fmt.Sprintf(":%d", port)},
+	)
+	c.Ports = []corev1.ContainerPort{{Name: "health", ContainerPort: port}}
+	c.ReadinessProbe = healthProbe("/readyz", port)
+	c.LivenessProbe = healthProbe("/healthz", port)
+	return c
+}
+
+// podHealthPort returns the port of the health endpoint of the refresh
+// sidecar, taken from --health-port unless the pod overrides it. An invalid
+// annotation is ignored.
+func podHealthPort(annotations map[string]string) int32 {
+	if v, ok := annotations[annotationHealthPort]; ok {
+		port, err := parseHealthPort(v)
+		if err == nil {
+			return port
+		}
+		log.info("ignoring invalid annotation", fields{"annotation": annotationHealthPort, fieldError: err})
+	}
+	return int32(healthPort)
+}
+
+func parseHealthPort(s string) (int32, error) {
+	port, err := strconv.ParseInt(s, 10, 32)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("%q is not a port number", s)
+	}
+	return int32(port), nil
+}
+
+func healthProbe(path string, port int32) *corev1.Probe {
+	return &corev1.Probe{
+		ProbeHandler: corev1.ProbeHandler{
+			HTTPGet: &corev1.HTTPGetAction{Path: path, Port: intstr.FromInt(int(port))},
+		},
+		PeriodSeconds:    5,
+		FailureThreshold: 3,
+	}
+}
+
+// mountSecrets mounts the secret volume in the containers of pod.
+func mountSecrets(pod *corev1.Pod, requests []secretRequest, volume string) error {
+	return addVolumeMounts(pod, volume, func(base string) []corev1.VolumeMount {
+		// The unindexed secret is mounted as the whole volume, as it always
+		// has been; every named secret is mounted from its own directory.
+		var mounts []corev1.VolumeMount
+		for _, r := range requests {
+			mounts = append(mounts, corev1.VolumeMount{
+				Name:      volume,
+				MountPath: r.containerMountPath(base),
+				SubPath:   r.name,
+			})
+		}
+		return mounts
+	})
+}
+
+// addVolumeMounts adds the mounts returned by mounts to the containers of
+// pod, passing the mount path requested for each container. Without the
+// containers annotation every application container gets the mounts; with it
+// only the listed containers, including init containers, do. Containers that
+// already mount volume are skipped, so that it is safe to call again after
+// containers were added to the pod.
+//
+// A mount on a path that the container already mounts something else on
+// would make the pod invalid; such conflicts are returned as a
+// mountConflictError and pod must then be discarded.
+func addVolumeMounts(pod *corev1.Pod, volume string, mounts func(base string) []corev1.VolumeMount) error {
+	targets, restricted := mountTargets(pod.ObjectMeta.Annotations)
+	found := map[string]bool{}
+	var conflicts []string
+	mount := func(containers []corev1.Container) {
+		for i := range containers {
+			c := &containers[i]
+			base, ok := targets[c.Name]
+			if restricted && !ok {
+				continue
+			}
+			found[c.Name] = true
+			if volume != "" && mountsVolume(*c, volume) {
+				continue
+			}
+			for _, m := range mounts(base) {
+				for _, existing := range c.VolumeMounts {
+					if path.Clean(existing.MountPath) == path.Clean(m.MountPath) {
+						conflicts = append(conflicts, fmt.Sprintf("container %s already mounts volume %s on %s", c.Name, existing.Name, existing.MountPath))
+					}
+				}
+				c.VolumeMounts = append(c.VolumeMounts, m)
+			}
+		}
+	}
+	mount(pod.Spec.Containers)
+	if restricted {
+		mount(pod.Spec.InitContainers)
+		for name := range targets {
+			if !found[name] {
+				log.info("container listed in annotation not found", fields{"container": name, "annotation": annotationContainers})
+			}
+		}
+	}
+	if len(conflicts) > 0 {
+		return &mountConflictError{conflicts: conflicts}
+	}
+	return nil
+}
+
+func mountsVolume(c corev1.Container, volume string) bool {
+	for _, m := range c.VolumeMounts {
+		if m.Name == volume {
+			return true
+		}
+	}
+	return false
+}
+
+// secretArns returns the ARNs requested by pod as a comma separated list.
+func secretArns(pod *corev1.Pod) string {
+	var arns []string
+	for _, r := range secretRequests(pod.ObjectMeta.Annotations) {
+		arns = append(arns, r.arn)
 	}
-	return applyPodPatch(ar, shouldPatchPod, fmt.Sprintf(podsSidecarPatch, sidecarImage))
+	return strings.Join(arns, ",")
+}
+
+// podName returns the name of the pod, or its generateName prefix when the
+// API server has not assigned a name yet.
+func podName(pod *corev1.Pod) string {
+	if pod.Name != "" {
+		return pod.Name
+	}
+	return pod.GenerateName
 }
 
 func hasContainer(containers []corev1.Container, containerName string) bool {
@@ -121,72 +401,102 @@ func hasContainer(containers []corev1.Container, containerName string) bool {
 	return false
 }
 
-
-func applyPodPatch(ar v1.AdmissionReview, shouldPatchPod func(*corev1.Pod) bool, patch string) *v1.AdmissionResponse {
-	klog.V(2).Info("mutating pods")
-	podResource := metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}
-	if ar.Request.Resource != podResource {
-		klog.Errorf("expect resource to be %s", podResource)
-		return nil
-	}
-	raw := ar.Request.Object.Raw
-	pod := corev1.Pod{}
-	deserializer := codecs.UniversalDeserializer()
-	if _, _, err := deserializer.Decode(raw, nil, &pod); err != nil {
-		klog.Error(err)
-		return toV1AdmissionResponse(err)
+// applyPodPatch decodes the pod under review and, if shouldPatchPod returns
+// true, applies mutate to a copy of it. The response carries the JSON patch
+// between the pod and the mutated copy, if they differ, with audit
+// annotations describing the injection and warnings about the annotations it
+// ignores. Pods that mutate fails for are rejected with its error. Nothing
+// outside the request is modified, so concurrent admissions are safe.
+func applyPodPatch(ar v1.AdmissionReview, shouldPatchPod func(*corev1.Pod) bool, mutate func(*corev1.Pod) error) *v1.AdmissionResponse {
+	log.debug("mutating pods", fields{fieldUID: ar.Request.UID})
+	pod, resp := decodePod(ar)
+	if resp != nil {
+		return resp
 	}
 	reviewResponse := v1.AdmissionResponse{}
 	reviewResponse.Allowed = true
-	if shouldPatchPod(&pod) {
-                mount_path ,mount_path_ok := pod.ObjectMeta.Annotations["secrets.k8s.aws/mount-path"]
-                secret_filename ,secret_filename_ok := pod.ObjectMeta.Annotations["secrets.k8s.aws/secret-filename"]
-                var path = "{\"op\": \"add\",\"path\": \"/spec/containers/" 
-                var value = "/volumeMounts/-\",\"value\": {\"mountPath\": \"/tmp/\",\"name\": \"secret-vol\"}}"
-                if mount_path_ok == true { 
-                    value = "/volumeMounts/-\",\"value\": {\"mountPath\":" + "\"" +  mount_path +"\""+ ",\"name\": \"secret-vol\"}}"
-                }
-                var vol_mounts = ""
-                for i, _ := range pod.Spec.Containers {
-                    if i == 0  {
-                        vol_mounts = path + strconv.Itoa(i) + value
-                        } else {
-                        vol_mounts = vol_mounts + "," + path + strconv.Itoa(i) + value
-                    }
-                }
-                if secret_filename_ok == true  {
-                   patch = patch + ",{\"name\":\"SECRET_FILENAME\",\"value\":"+ "\"" + secret_filename + "\"}"
-                }
-                if  len(pod.Spec.InitContainers) == 0 {
-                  patch = patch + `],"resources":{}}]},{"op":"add","path":"/spec/volumes/-","value":{"emptyDir": {"medium": "Memory"},"name": "secret-vol"}}` + "," + vol_mounts + "]"
-                } else  {
-                patch = patch + `],"resources":{}}},{"op":"add","path":"/spec/volumes/-","value":{"emptyDir": {"medium": "Memory"},"name": "secret-vol"}}` + "," + vol_mounts + "]"
-                } 
-		reviewResponse.Patch = []byte(patch)
+	if shouldPatchPod(pod) {
+		mutated := pod.DeepCopy()
+		defaults := applyNamespaceDefaults(mutated, ar.Request.Namespace)
+		reviewResponse.Warnings = annotationWarnings(mutated)
+		if err := mutate(mutated); err != nil {
+			return mutationFailed(ar, err)
+		}
+		if apiequality.Semantic.DeepEqual(pod, mutated) {
+			return &reviewResponse
+		}
+		patch, err := createPatch(pod, mutated)
+		if err != nil {
+			log.error("unable to create patch", fields{fieldUID: ar.Request.UID, fieldError: err})
+			return toV1AdmissionResponse(err)
+		}
+		reviewResponse.Patch = patch
 		pt := v1.PatchTypeJSONPatch
 		reviewResponse.PatchType = &pt
-                klog.Info(patch)
+		reviewResponse.AuditAnnotations = injectionAudit(pod, mutated, defaults)
+		log.info("patched pod", fields{
+			fieldUID:       ar.Request.UID,
+			fieldNamespace: ar.Request.Namespace,
+			fieldPod:       podName(pod),
+			fieldSecretArn: secretArns(pod),
+			"patch_bytes":  len(patch),
+		})
 	}
-//        klog.Info(&reviewResponse)
 	return &reviewResponse
 }
 
+// mutationFailed returns the response to a request whose object could not be
+// mutated because of err. Mount conflicts would make the object invalid and
+// reject it; other errors are failures of the webhook.
+func mutationFailed(ar v1.AdmissionReview, err error) *v1.AdmissionResponse {
+	var conflict *mountConflictError
+	if errors.As(err, &conflict) {
+		log.info("rejected object", fields{fieldUID: ar.Request.UID, fieldNamespace: ar.Request.Namespace, "name": ar.Request.Name, fieldError: err})
+		return &v1.AdmissionResponse{Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Reason:  metav1.StatusReasonInvalid,
+			Code:    422,
+			Message: err.Error(),
+		}}
+	}
+	log.error("unable to mutate object", fields{fieldUID: ar.Request.UID, fieldError: err})
+	return toV1AdmissionResponse(err)
+}
+
+// decodePod returns the pod under review. When the request is not for a pod
+// or cannot be decoded, it returns the response to send instead.
+func decodePod(ar v1.AdmissionReview) (*corev1.Pod, *v1.AdmissionResponse) {
+	podResource := metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}
+	if ar.Request.Resource != podResource {
+		err := fmt.Errorf("expect resource to be %s", podResource)
+		log.error("unexpected resource", fields{fieldUID: ar.Request.UID, fieldError: err})
+		return nil, toV1AdmissionResponse(err)
+	}
+	pod := &corev1.Pod{}
+	deserializer := codecs.UniversalDeserializer()
+	if _, _, err := deserializer.Decode(ar.Request.Object.Raw, nil, pod); err != nil {
+		log.error("unable to decode pod", fields{fieldUID: ar.Request.UID, fieldError: err})
+		return nil, toV1AdmissionResponse(err)
+	}
+	return pod, nil
+}
+
 // denySpecificAttachment denies `kubectl attach to-be-attached-pod -i -c=container1"
 // or equivalent client requests.
 func denySpecificAttachment(ar v1.AdmissionReview) *v1.AdmissionResponse {
-	klog.V(2).Info("handling attaching pods")
+	log.debug("handling attaching pods", fields{fieldUID: ar.Request.UID})
 	if ar.Request.Name != "to-be-attached-pod" {
 		return &v1.AdmissionResponse{Allowed: true}
 	}
 	podResource := metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}
 	if e, a := podResource, ar.Request.Resource; e != a {
 		err := fmt.Errorf("expect resource to be %s, got %s", e, a)
-		klog.Error(err)
+		log.error("unexpected resource", fields{fieldUID: ar.Request.UID, fieldError: err})
 		return toV1AdmissionResponse(err)
 	}
 	if e, a := "attach", ar.Request.SubResource; e != a {
 		err := fmt.Errorf("expect subresource to be %s, got %s", e, a)
-		klog.Error(err)
+		log.error("unexpected subresource", fields{fieldUID: ar.Request.UID, fieldError: err})
 		return toV1AdmissionResponse(err)
 	}
 
@@ -194,10 +504,10 @@ func denySpecificAttachment(ar v1.AdmissionReview) *v1.AdmissionResponse {
 	podAttachOptions := corev1.PodAttachOptions{}
 	deserializer := codecs.UniversalDeserializer()
 	if _, _, err := deserializer.Decode(raw, nil, &podAttachOptions); err != nil {
-		klog.Error(err)
+		log.error("unable to decode attach options", fields{fieldUID: ar.Request.UID, fieldError: err})
 		return toV1AdmissionResponse(err)
 	}
-	klog.V(2).Info(fmt.Sprintf("podAttachOptions=%#v\n", podAttachOptions))
+	log.debug("attach options", fields{"container": podAttachOptions.Container, "stdin": podAttachOptions.Stdin})
 	if !podAttachOptions.Stdin || podAttachOptions.Container != "container1" {
 		return &v1.AdmissionResponse{Allowed: true}
 	}
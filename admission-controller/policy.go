@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+// annotationInject set to "false" on a pod opts it out of the injection,
+// whatever secrets it requests.
+const annotationInject = "secrets.k8s.aws/inject"
+
+// Reasons for skipping the injection into a pod that requests secrets.
+const (
+	skipOptedOut             = "opted-out"
+	skipNamespaceDenied      = "namespace-denied"
+	skipNamespaceNotAllowed  = "namespace-not-allowed"
+	skipNamespaceNotSelected = "namespace-not-selected"
+)
+
+var injectionSkipped = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "injection_skipped_total",
+	Help:      "Pods and pod templates requesting secrets that were not injected, by reason: opted-out, namespace-denied, namespace-not-allowed or namespace-not-selected.",
+}, []string{"reason"})
+
+func init() {
+	metrics.MustRegister(injectionSkipped)
+}
+
+// injectionPolicy selects the namespaces whose pods secrets are injected
+// into. A namespace is selected when it is not denied, it is allowed or no
+// namespaces are allowed, and its labels match the selector.
+type injectionPolicy struct {
+	allowed  map[string]bool
+	denied   map[string]bool
+	selector labels.Selector
+}
+
+// policy is nil unless --allowed-namespaces, --denied-namespaces or
+// --namespace-selector is set.
+var policy *injectionPolicy
+
+// newInjectionPolicy returns the policy for the comma separated lists of
+// allowed and denied namespaces and the label selector of namespaces. It
+// returns nil when they are all empty.
+func newInjectionPolicy(allowed, denied, selector string) (*injectionPolicy, error) {
+	if allowed == "" && denied == "" && selector == "" {
+		return nil, nil
+	}
+	p := &injectionPolicy{
+		allowed:  namespaceSet(allowed),
+		denied:   namespaceSet(denied),
+		selector: labels.Everything(),
+	}
+	if selector != "" {
+		s, err := labels.Parse(selector)
+		if err != nil {
+			return nil, fmt.Errorf("--namespace-selector: %v", err)
+		}
+		p.selector = s
+	}
+	return p, nil
+}
+
+func namespaceSet(list string) map[string]bool {
+	set := map[string]bool{}
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			set[name] = true
+		}
+	}
+	return set
+}
+
+// skipReason returns why the secrets requested by pod, in namespace, must
+// not be injected, or an empty string if they must. The labels of namespaces
+// are only checked when namespaces are watched, which the inject command does
+// not do.
+func skipReason(pod *corev1.Pod, namespace string) string {
+	if strings.EqualFold(pod.ObjectMeta.Annotations[annotationInject], "false") {
+		return skipOptedOut
+	}
+	if policy == nil {
+		return ""
+	}
+	if policy.denied[namespace] {
+		return skipNamespaceDenied
+	}
+	if len(policy.allowed) > 0 && !policy.allowed[namespace] {
+		return skipNamespaceNotAllowed
+	}
+	if policy.selector.Empty() || namespaces == nil {
+		return ""
+	}
+	ns, err := namespaces.get(namespace)
+	if err != nil {
+		log.error("unable to look up namespace", fields{fieldNamespace: namespace, fieldError: err})
+		return skipNamespaceNotSelected
+	}
+	if !policy.selector.Matches(labels.Set(ns.Labels)) {
+		return skipNamespaceNotSelected
+	}
+	return ""
+}
+
+// skipInjection reports whether the injection into pod, under review in ar,
+// is skipped, and records why in the logs and metrics.
+func skipInjection(ar v1.AdmissionReview, pod *corev1.Pod) bool {
+	reason := skipReason(pod, ar.Request.Namespace)
+	if reason == "" {
+		return false
+	}
+	injectionSkipped.WithLabelValues(reason).Inc()
+	log.info("skipping injection", fields{
+		fieldUID:       ar.Request.UID,
+		fieldNamespace: ar.Request.Namespace,
+		"name":         ar.Request.Name,
+		"reason":       reason,
+	})
+	return true
+}
+
+// namespaceCache looks up namespaces in the cache of an informer, falling
+// back to the API for namespaces created too recently to be in it.
+type namespaceCache struct {
+	lister corelisters.NamespaceLister
+	client kubernetes.Interface
+}
+
+// namespaces is nil unless namespaces are watched.
+var namespaces *namespaceCache
+
+func (c *namespaceCache) get(name string) (*corev1.Namespace, error) {
+	ns, err := c.lister.Get(name)
+	if errors.IsNotFound(err) {
+		return c.client.CoreV1().Namespaces().Get(context.TODO(), name, metav1.GetOptions{})
+	}
+	return ns, err
+}
+
+// startNamespaceInformer fills namespaces from an informer and waits for the
+// cache to sync.
+func startNamespaceInformer(stop <-chan struct{}) error {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return err
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+	factory := informers.NewSharedInformerFactory(client, 10*time.Minute)
+	informer := factory.Core().V1().Namespaces()
+	lister := informer.Lister()
+	factory.Start(stop)
+	if !cache.WaitForCacheSync(stop, informer.Informer().HasSynced) {
+		return fmt.Errorf("namespace cache did not sync")
+	}
+	namespaces = &namespaceCache{lister: lister, client: client}
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestSkipReason(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	indexer.Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a", Labels: map[string]string{"secrets.k8s.aws/injection": "enabled"}}})
+	indexer.Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-b"}})
+	// team-c is not in the cache yet, as if it had just been created.
+	client := fake.NewSimpleClientset(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-c", Labels: map[string]string{"secrets.k8s.aws/injection": "enabled"}}})
+	namespaces = &namespaceCache{lister: corelisters.NewNamespaceLister(indexer), client: client}
+	defer func() { policy, namespaces = nil, nil }()
+
+	optedOut := secretPod(map[string]string{annotationSecretArn: testArn, annotationInject: "false"})
+	pod := secretPod(map[string]string{annotationSecretArn: testArn})
+	testCases := []struct {
+		name                      string
+		allowed, denied, selector string
+		pod                       *corev1.Pod
+		namespace                 string
+		want                      string
+	}{
+		{"no policy", "", "", "", pod, "team-b", ""},
+		{"opted out", "", "", "", optedOut, "team-a", skipOptedOut},
+		{"denied", "", "kube-system, team-b", "", pod, "team-b", skipNamespaceDenied},
+		{"denied wins", "team-b", "team-b", "", pod, "team-b", skipNamespaceDenied},
+		{"allowed", "team-a,team-b", "", "", pod, "team-b", ""},
+		{"not allowed", "team-a", "", "", pod, "team-b", skipNamespaceNotAllowed},
+		{"selected", "", "", "secrets.k8s.aws/injection=enabled", pod, "team-a", ""},
+		{"not selected", "", "", "secrets.k8s.aws/injection=enabled", pod, "team-b", skipNamespaceNotSelected},
+		{"selected, not cached", "", "", "secrets.k8s.aws/injection=enabled", pod, "team-c", ""},
+		{"unknown namespace", "", "", "secrets.k8s.aws/injection=enabled", pod, "team-d", skipNamespaceNotSelected},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := newInjectionPolicy(tc.allowed, tc.denied, tc.selector)
+			if err != nil {
+				t.Fatal(err)
+			}
+			policy = p
+			if got := skipReason(tc.pod, tc.namespace); got != tc.want {
+				t.Errorf("skipReason() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+
+	if _, err := newInjectionPolicy("", "", "secrets.k8s.aws/injection in ("); err == nil {
+		t.Error("expected an invalid selector to be rejected")
+	}
+}
+
+func TestMutatePodsPolicy(t *testing.T) {
+	sidecarImage = "test-image"
+	defer func() { policy = nil }()
+	p, err := newInjectionPolicy("", "default", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy = p
+
+	before := testutil.ToFloat64(injectionSkipped.WithLabelValues(skipNamespaceDenied))
+	pod := secretPod(map[string]string{annotationSecretArn: testArn})
+	if resp := mutatePods(podReview(t, pod)); !resp.Allowed || resp.Patch != nil {
+		t.Errorf("expected the pod to be allowed without a patch, got %#v", resp)
+	}
+	if got := testutil.ToFloat64(injectionSkipped.WithLabelValues(skipNamespaceDenied)) - before; got != 1 {
+		t.Errorf("skipped pods = %v, want 1", got)
+	}
+
+	// Skipped pods are not validated either.
+	invalid := secretPod(map[string]string{annotationSecretArn: "not-an-arn"})
+	if resp := validatePods(podReview(t, invalid)); !resp.Allowed {
+		t.Errorf("expected the skipped pod to be allowed, got %#v", resp)
+	}
+
+	policy = nil
+	optedOut := secretPod(map[string]string{annotationSecretArn: testArn, annotationInject: "false"})
+	if resp := mutatePods(podReview(t, optedOut)); !resp.Allowed || resp.Patch != nil {
+		t.Errorf("expected the opted out pod to be allowed without a patch, got %#v", resp)
+	}
+	if warnings := annotationWarnings(optedOut); len(warnings) > 0 {
+		t.Errorf("unexpected warnings %v", warnings)
+	}
+}
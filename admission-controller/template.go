@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"text/template"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// defaultTemplate is an injection template equivalent to the built-in
+// injection in init mode. It is a starting point for custom templates.
+const defaultTemplate = `initContainers:
+- name: secrets-init-container
+  image: {{ toJSON .Image }}
+  imagePullPolicy: {{ .ImagePullPolicy }}
+  env: {{ toJSON .Env }}
+  resources: {{ toJSON .Resources }}
+  securityContext: {{ toJSON .SecurityContext }}
+  volumeMounts:
+  - name: {{ $.VolumeName }}
+    mountPath: /tmp
+  {{- range .CredentialMounts }}
+  - {{ toJSON . }}
+  {{- end }}
+volumes:
+- name: {{ .VolumeName }}
+  emptyDir:
+    medium: Memory
+volumeMounts:
+{{- range .Secrets }}
+- name: {{ $.VolumeName }}
+  mountPath: {{ toJSON .MountPath }}
+  subPath: {{ toJSON .Name }}
+{{- end }}
+`
+
+// injection is what an injection template renders to, as YAML.
+type injection struct {
+	// InitContainers are added before the init containers of the pod.
+	InitContainers []corev1.Container `json:"initContainers,omitempty"`
+	// Containers are added after the containers of the pod.
+	Containers []corev1.Container `json:"containers,omitempty"`
+	Volumes    []corev1.Volume    `json:"volumes,omitempty"`
+	// VolumeMounts are added to the containers selected by the containers
+	// annotation, or to every container of the pod.
+	VolumeMounts     []corev1.VolumeMount          `json:"volumeMounts,omitempty"`
+	ImagePullSecrets []corev1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
+}
+
+// templateData is the data an injection template is executed with.
+type templateData struct {
+	Pod         *corev1.Pod
+	Annotations map[string]string
+	Secrets     []templateSecret
+	// Env selects the requested secrets in the fetcher and holds the AWS
+	// credentials of the pod, if any.
+	Env             []corev1.EnvVar
+	Image           string
+	ImagePullPolicy corev1.PullPolicy
+	Resources       corev1.ResourceRequirements
+	SecurityContext *corev1.SecurityContext
+	NativeSidecars  bool
+	// VolumeName is a volume name that the pod does not use yet.
+	VolumeName string
+	// CredentialMounts mount the token volumes of the AWS credentials of
+	// the pod, if any.
+	CredentialMounts []corev1.VolumeMount
+}
+
+// templateSecret is a requested secret as seen by an injection template.
+type templateSecret struct {
+	// Name is empty for the unindexed secret and is also the directory of
+	// the secret volume that a named secret is written to.
+	Name string
+	Arn  string
+	// MountPath is where the secret is mounted in the containers whose
+	// volume mounts are being rendered.
+	MountPath string
+	Filename  string
+}
+
+var templateFuncs = template.FuncMap{
+	"toJSON": func(v interface{}) (string, error) {
+		out, err := json.Marshal(v)
+		return string(out), err
+	},
+	"default": func(def, v interface{}) interface{} {
+		if s, ok := v.(string); ok && s == "" || v == nil {
+			return def
+		}
+		return v
+	},
+}
+
+func parseTemplate(text string) (*template.Template, error) {
+	return template.New("injection").Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+}
+
+// templateFile holds the injection template read from a file, typically a
+// mounted ConfigMap, and reloads it when the file changes.
+type templateFile struct {
+	path string
+
+	mu       sync.RWMutex
+	tmpl     *template.Template
+	contents []byte
+}
+
+// injectionTemplate is nil unless --injection-template is set, in which case
+// it replaces the built-in injection.
+var injectionTemplate *templateFile
+
+// loadTemplateFile reads and parses the template at path.
+func loadTemplateFile(path string) (*templateFile, error) {
+	f := &templateFile{path: path}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// reload reads the file again and, if it changed and parses, replaces the
+// template. An invalid template is reported and the previous one is kept.
+func (f *templateFile) reload() error {
+	contents, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	f.mu.RLock()
+	unchanged := f.tmpl != nil && bytes.Equal(contents, f.contents)
+	f.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+	tmpl, err := parseTemplate(string(contents))
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.tmpl, f.contents = tmpl, contents
+	f.mu.Unlock()
+	log.info("loaded injection template", fields{"path": f.path})
+	return nil
+}
+
+// watch reloads the template every interval until stop is closed. Files
+// mounted from a ConfigMap are replaced through a symlink, which rules out
+// watching them with inotify, so the file is polled.
+func (f *templateFile) watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := f.reload(); err != nil {
+				log.error("unable to reload injection template, keeping the previous one", fields{"path": f.path, fieldError: err})
+			}
+		}
+	}
+}
+
+func (f *templateFile) template() *template.Template {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.tmpl
+}
+
+// renderInjection executes tmpl for pod, with the secrets mounted under base
+// as in containerMountPath, and parses the result.
+func renderInjection(tmpl *template.Template, pod *corev1.Pod, base string) (*injection, error) {
+	requests := secretRequests(pod.ObjectMeta.Annotations)
+	data := templateData{
+		Pod:             pod,
+		Annotations:     pod.ObjectMeta.Annotations,
+		Env:             fetcherEnv(pod, requests),
+		Image:           containerImage(pod.ObjectMeta.Annotations),
+		ImagePullPolicy: containerPullPolicy(pod.ObjectMeta.Annotations),
+		Resources:       containerResources(pod.ObjectMeta.Annotations),
+		SecurityContext: containerSecurityContext(),
+		NativeSidecars:  nativeSidecars,
+		VolumeName:      secretVolume(pod),
+	}
+	_, data.CredentialMounts = podCredentials(pod)
+	for _, r := range requests {
+		data.Secrets = append(data.Secrets, templateSecret{
+			Name:      r.name,
+			Arn:       r.arn,
+			MountPath: r.containerMountPath(base),
+			Filename:  r.filename,
+		})
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return nil, fmt.Errorf("unable to execute injection template: %v", err)
+	}
+	inj := &injection{}
+	if err := yaml.UnmarshalStrict(out.Bytes(), inj); err != nil {
+		return nil, fmt.Errorf("injection template did not render to a valid injection: %v", err)
+	}
+	return inj, nil
+}
+
+// injectFromTemplate applies the injection rendered by tmpl to pod. Pods
+// that already have one of the rendered containers are left alone. The
+// volume mounts of containers that the containers annotation gives a mount
+// path are rendered again with the secrets mounted under it.
+func injectFromTemplate(tmpl *template.Template, pod *corev1.Pod) error {
+	inj, err := renderInjection(tmpl, pod, "")
+	if err != nil {
+		return err
+	}
+	mounts := map[string][]corev1.VolumeMount{"": inj.VolumeMounts}
+	targets, _ := mountTargets(pod.ObjectMeta.Annotations)
+	for _, base := range targets {
+		if _, ok := mounts[base]; ok {
+			continue
+		}
+		rendered, err := renderInjection(tmpl, pod, base)
+		if err != nil {
+			return err
+		}
+		mounts[base] = rendered.VolumeMounts
+	}
+	for _, c := range append(append([]corev1.Container(nil), inj.InitContainers...), inj.Containers...) {
+		if hasContainer(pod.Spec.InitContainers, c.Name) || hasContainer(pod.Spec.Containers, c.Name) {
+			return nil
+		}
+	}
+
+	if err := addVolumeMounts(pod, "", func(base string) []corev1.VolumeMount { return mounts[base] }); err != nil {
+		return err
+	}
+	addInitContainers(pod, inj.InitContainers)
+	pod.Spec.Containers = append(pod.Spec.Containers, inj.Containers...)
+	pod.Spec.Volumes = append(pod.Spec.Volumes, inj.Volumes...)
+	addCredentials(pod)
+	for _, s := range inj.ImagePullSecrets {
+		if !hasPullSecret(pod.Spec.ImagePullSecrets, s.Name) {
+			pod.Spec.ImagePullSecrets = append(pod.Spec.ImagePullSecrets, s)
+		}
+	}
+	addImagePullSecrets(pod)
+	return nil
+}
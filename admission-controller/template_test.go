@@ -0,0 +1,148 @@
+package main
+
+import (
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+)
+
+func withTemplate(t *testing.T, text string) {
+	path := filepath.Join(t.TempDir(), "template.yaml")
+	if err := ioutil.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := loadTemplateFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	injectionTemplate = f
+	t.Cleanup(func() { injectionTemplate = nil })
+}
+
+func TestDefaultTemplateMatchesBuiltinInjection(t *testing.T) {
+	sidecarImage = "test-image"
+	annotations := map[string]string{
+		annotationSecretArn:               testArn,
+		annotationSecretFilename:          "db.json",
+		annotationSecretArn + ".api":      testArn,
+		annotationMountPath + ".api":      "/etc/api",
+		annotationImagePullSecrets:        "ecr",
+		annotationContainers:              "app",
+		annotationSecretFilename + ".api": "key",
+	}
+	builtin := admit(t, mutatePods, secretPod(annotations))
+
+	withTemplate(t, defaultTemplate)
+	templated := admit(t, mutatePods, secretPod(annotations))
+	if !apiequality.Semantic.DeepEqual(builtin, templated) {
+		t.Errorf("default template differs from the built-in injection:\nbuilt-in: %#v\ntemplate: %#v", builtin.Spec, templated.Spec)
+	}
+
+	// A pod that already has the rendered containers is not patched again.
+	if resp := mutatePods(podReview(t, templated)); !resp.Allowed || resp.Patch != nil {
+		t.Errorf("expected an injected pod to be left alone, got %#v", resp)
+	}
+}
+
+// TestDefaultTemplateMountTargets checks that the secrets are mounted under
+// the paths that the containers annotation gives each container.
+func TestDefaultTemplateMountTargets(t *testing.T) {
+	sidecarImage = "test-image"
+	annotations := map[string]string{
+		annotationSecretArn:          testArn,
+		annotationSecretArn + ".api": testArn,
+		annotationContainers:         "app:/etc/secrets,proxy",
+	}
+	builtin := admit(t, mutatePods, secretPod(annotations))
+
+	withTemplate(t, defaultTemplate)
+	templated := admit(t, mutatePods, secretPod(annotations))
+	if !apiequality.Semantic.DeepEqual(builtin, templated) {
+		t.Errorf("default template differs from the built-in injection:\nbuilt-in: %#v\ntemplate: %#v", builtin.Spec, templated.Spec)
+	}
+	want := map[string][]string{
+		"app":   {"/etc/secrets", "/etc/secrets/api"},
+		"proxy": {defaultMountPath, path.Join(defaultMountPath, "api")},
+	}
+	for _, c := range templated.Spec.Containers {
+		var got []string
+		for _, m := range c.VolumeMounts {
+			if m.Name == secretVolumeName {
+				got = append(got, m.MountPath)
+			}
+		}
+		if !reflect.DeepEqual(got, want[c.Name]) {
+			t.Errorf("%s: secrets mounted on %v, want %v", c.Name, got, want[c.Name])
+		}
+	}
+}
+
+func TestTemplateReload(t *testing.T) {
+	sidecarImage = "test-image"
+	withTemplate(t, defaultTemplate)
+	custom := `initContainers:
+- name: fetch-{{ len .Secrets }}-secrets
+  image: {{ .Image }}
+  env: {{ toJSON .Env }}
+volumes:
+- name: secrets
+  emptyDir: {}
+volumeMounts:
+- name: secrets
+  mountPath: {{ index .Annotations "example.com/secrets-path" | default "/secrets" }}
+`
+	if err := ioutil.WriteFile(injectionTemplate.path, []byte(custom), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := injectionTemplate.reload(); err != nil {
+		t.Fatal(err)
+	}
+	pod := admit(t, mutatePods, secretPod(map[string]string{annotationSecretArn: testArn}))
+	if c := pod.Spec.InitContainers[0]; c.Name != "fetch-1-secrets" || c.Image != "test-image" {
+		t.Errorf("unexpected init container %s/%s", c.Name, c.Image)
+	}
+	if m := pod.Spec.Containers[0].VolumeMounts; len(m) != 1 || m[0].MountPath != "/secrets" {
+		t.Errorf("unexpected mounts %#v", m)
+	}
+
+	// An invalid template is reported and the previous one is kept.
+	if err := ioutil.WriteFile(injectionTemplate.path, []byte("{{ .Image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := injectionTemplate.reload(); err == nil {
+		t.Error("expected an invalid template to be rejected")
+	}
+	pod = admit(t, mutatePods, secretPod(map[string]string{annotationSecretArn: testArn}))
+	if c := pod.Spec.InitContainers[0]; c.Name != "fetch-1-secrets" {
+		t.Errorf("previous template was not kept, got init container %s", c.Name)
+	}
+}
+
+func TestTemplateRenderErrors(t *testing.T) {
+	for name, text := range map[string]string{
+		"unknown field":  "initContainers:\n- name: fetch\n  imag: x\n",
+		"not a template": "containers: {{ fail }}",
+		"execution":      "containers: {{ index .Pod.Spec.Containers 5 }}",
+	} {
+		t.Run(name, func(t *testing.T) {
+			tmpl, err := parseTemplate(text)
+			if err != nil {
+				return
+			}
+			if err := injectFromTemplate(tmpl, secretPod(map[string]string{annotationSecretArn: testArn})); err == nil {
+				t.Error("expected the injection to fail")
+			}
+		})
+	}
+
+	withTemplate(t, "initContainers: {{ index .Pod.Spec.Containers 5 }}")
+	resp := mutatePods(podReview(t, secretPod(map[string]string{annotationSecretArn: testArn}, corev1.Container{Name: "migrate"})))
+	if resp.Allowed {
+		t.Error("expected the pod to be rejected when the template fails")
+	}
+}
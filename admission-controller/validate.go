@@ -0,0 +1,339 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const annotationPrefix = "secrets.k8s.aws/"
+
+// indexedAnnotations can be suffixed with the name of a secret; the other
+// known annotations apply to the whole pod.
+var (
+	indexedAnnotations = []string{annotationSecretArn, annotationMountPath, annotationSecretFilename}
+	podAnnotations     = []string{
+		annotationContainers,
+		annotationMode,
+		annotationRefreshInterval,
+		annotationHealthPort,
+		annotationCPURequest,
+		annotationMemoryRequest,
+		annotationCPULimit,
+		annotationMemoryLimit,
+		annotationImagePullPolicy,
+		annotationImagePullSecrets,
+		annotationImage,
+		annotationInjected,
+		annotationInject,
+	}
+)
+
+// secretArnPattern matches the ARN of a Secrets Manager secret and captures
+// its region.
+var secretArnPattern = regexp.MustCompile(`^arn:aws(?:-[a-z]+)*:secretsmanager:([a-z0-9-]+):[0-9]{12}:secret:[A-Za-z0-9/_+=.@-]+$`)
+
+// validatePods rejects pods whose secret annotations cannot work, so that
+// mistakes are reported by kubectl instead of by a failing init container.
+// Problems that may be intended, such as secrets in another region than the
+// cluster, are returned as warnings. With warnOnly every problem is a
+// warning.
+//
+// The AWS credentials of pods that request secrets are checked here rather
+// than in mutatePods, since validating webhooks see the pod after every
+// mutation, including the one that adds EKS Pod Identity credentials. So is
+// their access to the requested secrets, which must be allowed by a
+// SecretAccessPolicy or ClusterSecretAccessPolicy.
+//
+// Pods that the injection policy skips are only checked against the access
+// policies. Updates that leave the secret annotations and the secrets of the
+// fetcher containers unchanged are always allowed, so that running pods can
+// still be updated, e.g. to remove their finalizers, after the policies
+// changed.
+func validatePods(ar v1.AdmissionReview) *v1.AdmissionResponse {
+	log.debug("validating pods", fields{fieldUID: ar.Request.UID})
+	pod, resp := decodePod(ar)
+	if resp != nil {
+		return resp
+	}
+	if ar.Request.Operation == v1.Update {
+		old := &corev1.Pod{}
+		if _, _, err := codecs.UniversalDeserializer().Decode(ar.Request.OldObject.Raw, nil, old); err != nil {
+			log.error("unable to decode old pod", fields{fieldUID: ar.Request.UID, fieldError: err})
+			return toV1AdmissionResponse(err)
+		}
+		if !secretsChanged(old, pod) {
+			return &v1.AdmissionResponse{Allowed: true}
+		}
+	}
+	var problems, warnings []string
+	var audit map[string]string
+	if skipReason(pod, ar.Request.Namespace) == "" {
+		problems, warnings = validateAnnotations(pod)
+		if len(secretRequests(pod.ObjectMeta.Annotations)) > 0 {
+			var problem string
+			audit, problem = checkCredentials(pod, ar.Request.Namespace)
+			if problem != "" && credentialsPolicy == credentialsDeny {
+				problems = append(problems, problem)
+			} else if problem != "" {
+				warnings = append(warnings, problem)
+			}
+		}
+	}
+	// The access policies also apply to pods that the injection skips, which
+	// can still bring their own fetcher.
+	accessAudit, denied := checkAccess(pod, ar.Request.Namespace)
+	for k, v := range accessAudit {
+		if audit == nil {
+			audit = map[string]string{}
+		}
+		audit[k] = v
+	}
+	if accessPolicy == accessDeny {
+		problems = append(problems, denied...)
+	} else {
+		warnings = append(warnings, denied...)
+	}
+	if warnOnly {
+		warnings, problems = append(problems, warnings...), nil
+	}
+	reviewResponse := &v1.AdmissionResponse{Allowed: len(problems) == 0, Warnings: warnings, AuditAnnotations: audit}
+	if len(problems) > 0 {
+		log.info("rejected pod", fields{
+			fieldUID:       ar.Request.UID,
+			fieldNamespace: ar.Request.Namespace,
+			fieldPod:       podName(pod),
+			"problems":     len(problems),
+		})
+		reviewResponse.Result = &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Reason:  metav1.StatusReasonInvalid,
+			Code:    422,
+			Message: "invalid secret annotations: " + strings.Join(problems, "; "),
+		}
+	}
+	return reviewResponse
+}
+
+// secretsChanged reports whether the secrets.k8s.aws/ annotations or the
+// secrets selected by the fetcher containers differ between old and pod.
+func secretsChanged(old, pod *corev1.Pod) bool {
+	if !reflect.DeepEqual(secretAnnotations(old), secretAnnotations(pod)) {
+		return true
+	}
+	oldSecrets, oldProblems := podSecrets(old)
+	secrets, problems := podSecrets(pod)
+	return !reflect.DeepEqual(oldSecrets, secrets) || !reflect.DeepEqual(oldProblems, problems)
+}
+
+func secretAnnotations(pod *corev1.Pod) map[string]string {
+	annotations := map[string]string{}
+	for k, v := range pod.ObjectMeta.Annotations {
+		if strings.HasPrefix(k, annotationPrefix) {
+			annotations[k] = v
+		}
+	}
+	return annotations
+}
+
+// validateAnnotations returns the problems with the secret annotations of pod
+// and the warnings about them.
+func validateAnnotations(pod *corev1.Pod) (problems, warnings []string) {
+	annotations := pod.ObjectMeta.Annotations
+	requests := secretRequests(annotations)
+	problems = unusedAnnotations(annotations, requests)
+
+	region := ""
+	for _, r := range requests {
+		arnKey := indexed(annotationSecretArn, r.name)
+		m := secretArnPattern.FindStringSubmatch(r.arn)
+		if m == nil {
+			problems = append(problems, fmt.Sprintf("%s: %q is not the ARN of a Secrets Manager secret", arnKey, r.arn))
+		} else if region == "" {
+			region = m[1]
+		} else if m[1] != region {
+			problems = append(problems, fmt.Sprintf("%s: all secrets of a pod must be in the same region, found %s and %s", arnKey, region, m[1]))
+		}
+		if r.mountPath != "" && !path.IsAbs(r.mountPath) {
+			problems = append(problems, fmt.Sprintf("%s: %q must be an absolute path", indexed(annotationMountPath, r.name), r.mountPath))
+		}
+		for _, segment := range strings.Split(r.filename, "/") {
+			if segment == ".." {
+				problems = append(problems, fmt.Sprintf("%s: %q must not contain ..", indexed(annotationSecretFilename, r.name), r.filename))
+				break
+			}
+		}
+	}
+	if region != "" && clusterRegion != "" && region != clusterRegion {
+		warnings = append(warnings, fmt.Sprintf("secrets are in %s but the cluster is in %s", region, clusterRegion))
+	}
+
+	targets, restricted := mountTargets(annotations)
+	for name, mountPath := range targets {
+		if mountPath != "" && !path.IsAbs(mountPath) {
+			problems = append(problems, fmt.Sprintf("%s: %q must be an absolute path for container %s", annotationContainers, mountPath, name))
+		}
+		if !hasContainer(pod.Spec.Containers, name) && !hasContainer(pod.Spec.InitContainers, name) {
+			problems = append(problems, fmt.Sprintf("%s: the pod has no container %s", annotationContainers, name))
+		}
+	}
+	// Mounts of the secret volume are not conflicts. Before the injection,
+	// or with a template, it is assumed to have the default name.
+	volume, _ := injectedVolume(pod)
+	if volume == "" {
+		volume = secretVolumeName
+	}
+	mounted := pod.Spec.Containers
+	if restricted {
+		mounted = append(append([]corev1.Container(nil), mounted...), pod.Spec.InitContainers...)
+	}
+	for _, c := range mounted {
+		base, ok := targets[c.Name]
+		if restricted && !ok || c.Name == initContainerName || c.Name == refreshContainerName {
+			continue
+		}
+		problems = append(problems, overlappingMounts(c, requests, base, volume)...)
+	}
+
+	if mode, ok := annotations[annotationMode]; ok && mode != modeInit && mode != modeSidecar {
+		problems = append(problems, fmt.Sprintf("%s: %q must be %s or %s", annotationMode, mode, modeInit, modeSidecar))
+	}
+	if v, ok := annotations[annotationRefreshInterval]; ok {
+		if d, err := time.ParseDuration(v); err != nil || d <= 0 {
+			problems = append(problems, fmt.Sprintf("%s: %q is not a positive duration such as 5m", annotationRefreshInterval, v))
+		}
+	}
+	if v, ok := annotations[annotationHealthPort]; ok {
+		if _, err := parseHealthPort(v); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", annotationHealthPort, err))
+		}
+	}
+	if annotations[annotationMode] == modeSidecar {
+		problems = append(problems, healthPortConflicts(pod)...)
+	}
+	for _, key := range []string{annotationCPURequest, annotationMemoryRequest, annotationCPULimit, annotationMemoryLimit} {
+		if v, ok := annotations[key]; ok {
+			if _, err := parseQuantity(v); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %q is not a quantity", key, v))
+			}
+		}
+	}
+	if v, ok := annotations[annotationImagePullPolicy]; ok && !validPullPolicy(v) {
+		problems = append(problems, fmt.Sprintf("%s: %q must be Always, IfNotPresent or Never", annotationImagePullPolicy, v))
+	}
+	if v, ok := annotations[annotationImage]; ok && !imageAllowed(v) {
+		problems = append(problems, fmt.Sprintf("%s: %q is not one of the images allowed by --allowed-images", annotationImage, v))
+	}
+	return problems, warnings
+}
+
+// healthPortConflicts returns the problems with the containers of pod that
+// use the port of the health endpoint of the refresh sidecar, which shares
+// the network namespace of the pod with them.
+func healthPortConflicts(pod *corev1.Pod) []string {
+	port := podHealthPort(pod.ObjectMeta.Annotations)
+	var problems []string
+	for _, containers := range [][]corev1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for _, c := range containers {
+			if c.Name == refreshContainerName {
+				continue
+			}
+			for _, p := range c.Ports {
+				if p.ContainerPort == port && (p.Protocol == "" || p.Protocol == corev1.ProtocolTCP) {
+					problems = append(problems, fmt.Sprintf("container %s already uses port %d, which the refresh sidecar serves its probes on; set %s to another port", c.Name, port, annotationHealthPort))
+				}
+			}
+		}
+	}
+	return problems
+}
+
+// unusedAnnotations returns the problems with the secrets.k8s.aws/
+// annotations that the injection does not use: unknown annotations and
+// indexed annotations that do not belong to a requested secret.
+func unusedAnnotations(annotations map[string]string, requests []secretRequest) []string {
+	names := map[string]bool{}
+	for _, r := range requests {
+		names[r.name] = true
+	}
+	var keys []string
+	for key := range annotations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var problems []string
+	for _, key := range keys {
+		if !strings.HasPrefix(key, annotationPrefix) || isPodAnnotation(key) {
+			continue
+		}
+		name, ok := annotationName(key)
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("%s: unknown annotation", key))
+		case names[name]:
+		case annotations[indexed(annotationSecretArn, name)] != "":
+			problems = append(problems, fmt.Sprintf("%s: %q is not a valid secret name, it must be a DNS label", key, name))
+		default:
+			problems = append(problems, fmt.Sprintf("%s: there is no %s annotation", key, indexed(annotationSecretArn, name)))
+		}
+	}
+	return problems
+}
+
+// overlappingMounts returns the problems with the mounts of the requested
+// secrets in c. A secret must not be mounted on or inside another secret, or
+// on a path that c already mounts a volume other than the secret volume on.
+// Named secrets mounted at their own directory inside the mount of the
+// unindexed secret are allowed, since that directory holds the same files.
+func overlappingMounts(c corev1.Container, requests []secretRequest, base, volume string) []string {
+	var problems []string
+	mountPaths := map[string]string{}
+	for _, r := range requests {
+		mountPaths[r.name] = path.Clean(r.containerMountPath(base))
+	}
+	for i, r := range requests {
+		p := mountPaths[r.name]
+		for _, other := range requests[i+1:] {
+			q := mountPaths[other.name]
+			if r.name == "" && q == path.Join(p, other.name) {
+				continue
+			}
+			if p == q || strings.HasPrefix(q, p+"/") || strings.HasPrefix(p, q+"/") {
+				problems = append(problems, fmt.Sprintf("container %s: secrets %q and %q are mounted on overlapping paths %s and %s", c.Name, r.name, other.name, p, q))
+			}
+		}
+		for _, m := range c.VolumeMounts {
+			if m.Name != volume && path.Clean(m.MountPath) == p {
+				problems = append(problems, fmt.Sprintf("container %s: secret %q is mounted on %s, which already mounts volume %s", c.Name, r.name, p, m.Name))
+			}
+		}
+	}
+	return problems
+}
+
+func isPodAnnotation(key string) bool {
+	for _, a := range podAnnotations {
+		if key == a {
+			return true
+		}
+	}
+	return false
+}
+
+// annotationName returns the secret name of an indexed annotation key.
+func annotationName(key string) (string, bool) {
+	for _, base := range indexedAnnotations {
+		if name, ok := annotationIndex(key, base); ok {
+			return name, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestValidatePods(t *testing.T) {
+	const otherRegionArn = "arn:aws:secretsmanager:eu-west-1:123456789012:secret:api-AbCdEf"
+	defer func() { clusterRegion = "" }()
+	clusterRegion = "us-east-1"
+
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		problem     string
+		warning     string
+	}{
+		{
+			name:        "no annotations",
+			annotations: nil,
+		},
+		{
+			name: "valid",
+			annotations: map[string]string{
+				annotationSecretArn:              testArn,
+				annotationSecretArn + ".db":      testArn,
+				annotationMountPath + ".db":      "/var/db",
+				annotationSecretFilename + ".db": "creds/db.json",
+				annotationContainers:             "app:/etc/secrets",
+				annotationMode:                   modeSidecar,
+				annotationRefreshInterval:        "10m",
+				annotationMemoryLimit:            "128Mi",
+			},
+		},
+		{
+			name:        "malformed ARN",
+			annotations: map[string]string{annotationSecretArn: "arn:aws:secretsmanager:us-east-1:secret:db"},
+			problem:     `secrets.k8s.aws/secret-arn: "arn:aws:secretsmanager:us-east-1:secret:db" is not the ARN of a Secrets Manager secret`,
+		},
+		{
+			name:        "secret name instead of ARN",
+			annotations: map[string]string{annotationSecretArn: "prod/db"},
+			problem:     "is not the ARN of a Secrets Manager secret",
+		},
+		{
+			name:        "regions differ between secrets",
+			annotations: map[string]string{annotationSecretArn: testArn, annotationSecretArn + ".api": otherRegionArn},
+			problem:     "all secrets of a pod must be in the same region, found us-east-1 and eu-west-1",
+		},
+		{
+			name:        "secret in another region than the cluster",
+			annotations: map[string]string{annotationSecretArn: otherRegionArn},
+			warning:     "secrets are in eu-west-1 but the cluster is in us-east-1",
+		},
+		{
+			name:        "relative mount path",
+			annotations: map[string]string{annotationSecretArn: testArn, annotationMountPath: "secrets"},
+			problem:     `secrets.k8s.aws/mount-path: "secrets" must be an absolute path`,
+		},
+		{
+			name:        "relative container mount path",
+			annotations: map[string]string{annotationSecretArn: testArn, annotationContainers: "app:secrets"},
+			problem:     "must be an absolute path for container app",
+		},
+		{
+			name: "overlapping mount paths",
+			annotations: map[string]string{
+				annotationSecretArn + ".db":  testArn,
+				annotationMountPath + ".db":  "/var/secrets",
+				annotationSecretArn + ".api": testArn,
+				annotationMountPath + ".api": "/var/secrets/api",
+			},
+			problem: `container app: secrets "api" and "db" are mounted on overlapping paths /var/secrets/api and /var/secrets`,
+		},
+		{
+			name:        "mount path used by another volume",
+			annotations: map[string]string{annotationSecretArn: testArn, annotationMountPath: "/etc/proxy/"},
+			problem:     "container proxy: secret \"\" is mounted on /etc/proxy, which already mounts volume config",
+		},
+		{
+			name:        "filename escaping the volume",
+			annotations: map[string]string{annotationSecretArn: testArn, annotationSecretFilename: "../../etc/passwd"},
+			problem:     `secrets.k8s.aws/secret-filename: "../../etc/passwd" must not contain ..`,
+		},
+		{
+			name:        "unknown annotation",
+			annotations: map[string]string{annotationSecretArn: testArn, "secrets.k8s.aws/mountpath": "/var"},
+			problem:     "secrets.k8s.aws/mountpath: unknown annotation",
+		},
+		{
+			name:        "indexed annotation without a secret",
+			annotations: map[string]string{annotationSecretArn: testArn, annotationMountPath + ".db": "/var/db"},
+			problem:     "secrets.k8s.aws/mount-path.db: there is no secrets.k8s.aws/secret-arn.db annotation",
+		},
+		{
+			name:        "invalid secret name",
+			annotations: map[string]string{annotationSecretArn + ".DB": testArn},
+			problem:     `secrets.k8s.aws/secret-arn.DB: "DB" is not a valid secret name`,
+		},
+		{
+			name:        "unknown container",
+			annotations: map[string]string{annotationSecretArn: testArn, annotationContainers: "worker"},
+			problem:     "the pod has no container worker",
+		},
+		{
+			name:        "invalid mode",
+			annotations: map[string]string{annotationSecretArn: testArn, annotationMode: "daemon"},
+			problem:     `secrets.k8s.aws/mode: "daemon" must be init or sidecar`,
+		},
+		{
+			name:        "invalid health port",
+			annotations: map[string]string{annotationSecretArn: testArn, annotationMode: modeSidecar, annotationHealthPort: "http"},
+			problem:     `secrets.k8s.aws/health-port: "http" is not a port number`,
+		},
+		{
+			name:        "invalid memory limit",
+			annotations: map[string]string{annotationSecretArn: testArn, annotationMemoryLimit: "lots"},
+			problem:     `secrets.k8s.aws/memory-limit: "lots" is not a quantity`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := validatePods(podReview(t, secretPod(tc.annotations)))
+			if tc.problem == "" {
+				if !resp.Allowed {
+					t.Errorf("pod was rejected: %s", resp.Result.Message)
+				}
+			} else if resp.Allowed {
+				t.Errorf("pod was allowed, expected %q", tc.problem)
+			} else if !strings.Contains(resp.Result.Message, tc.problem) {
+				t.Errorf("message %q does not contain %q", resp.Result.Message, tc.problem)
+			}
+			if tc.warning != "" && (len(resp.Warnings) != 1 || resp.Warnings[0] != tc.warning) {
+				t.Errorf("got warnings %q, want %q", resp.Warnings, tc.warning)
+			}
+			if tc.warning == "" && len(resp.Warnings) > 0 {
+				t.Errorf("unexpected warnings %q", resp.Warnings)
+			}
+		})
+	}
+}
+
+func TestValidatePodsWarnOnly(t *testing.T) {
+	defer func() { warnOnly = false }()
+	warnOnly = true
+	resp := validatePods(podReview(t, secretPod(map[string]string{annotationSecretArn: "not-an-arn"})))
+	if !resp.Allowed || len(resp.Warnings) != 1 || !strings.Contains(resp.Warnings[0], "not-an-arn") {
+		t.Errorf("expected the pod to be allowed with a warning, got %#v", resp)
+	}
+}
+
+// TestValidatePodsAfterMutation checks that the mutations of the webhook are
+// accepted by the validating webhook, which runs after it.
+func TestValidatePodsAfterMutation(t *testing.T) {
+	sidecarImage = "test-image"
+	pod := admit(t, mutatePods, secretPod(map[string]string{
+		annotationSecretArn:         testArn,
+		annotationSecretArn + ".db": testArn,
+		annotationMode:              modeSidecar,
+	}, corev1.Container{Name: "migrate", Image: "migrate"}))
+	if resp := validatePods(podReview(t, pod)); !resp.Allowed {
+		t.Errorf("mutated pod was rejected: %s", resp.Result.Message)
+	}
+}
+
+func TestValidatePodsHealthPort(t *testing.T) {
+	sidecarImage = "test-image"
+	podWith := func(annotations map[string]string) *corev1.Pod {
+		pod := secretPod(annotations)
+		pod.Spec.Containers[0].Ports = []corev1.ContainerPort{{Name: "metrics", ContainerPort: 8089}}
+		return pod
+	}
+
+	resp := validatePods(podReview(t, podWith(map[string]string{annotationSecretArn: testArn, annotationMode: modeSidecar})))
+	if want := "container app already uses port 8089"; resp.Allowed || !strings.Contains(resp.Result.Message, want) {
+		t.Errorf("expected the pod to be rejected with %q, got %#v", want, resp)
+	}
+	// The port only matters in sidecar mode.
+	if resp := validatePods(podReview(t, podWith(map[string]string{annotationSecretArn: testArn}))); !resp.Allowed {
+		t.Errorf("pod in init mode was rejected: %s", resp.Result.Message)
+	}
+
+	// The annotation moves the health endpoint out of the way.
+	pod := admit(t, mutatePods, podWith(map[string]string{annotationSecretArn: testArn, annotationMode: modeSidecar, annotationHealthPort: "9000"}))
+	sidecar := pod.Spec.Containers[len(pod.Spec.Containers)-1]
+	if sidecar.Name != refreshContainerName || sidecar.Ports[0].ContainerPort != 9000 || sidecar.ReadinessProbe.HTTPGet.Port.IntValue() != 9000 {
+		t.Errorf("refresh sidecar does not use the annotated port: %#v", sidecar)
+	}
+	if resp := validatePods(podReview(t, pod)); !resp.Allowed {
+		t.Errorf("mutated pod was rejected: %s", resp.Result.Message)
+	}
+}
+
+func TestValidatePodsCredentials(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, sa := range []*corev1.ServiceAccount{
+		{ObjectMeta: metav1.ObjectMeta{Name: "irsa", Namespace: "default", Annotations: map[string]string{annotationRoleArn: "arn:aws:iam::123456789012:role/app"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "default", Namespace: "default"}},
+	} {
+		indexer.Add(sa)
+	}
+	serviceAccounts = corelisters.NewServiceAccountLister(indexer)
+	defer func() { serviceAccounts, credentialsPolicy = nil, credentialsWarn }()
+
+	podWith := func(serviceAccount string, podIdentity bool) *corev1.Pod {
+		pod := secretPod(map[string]string{annotationSecretArn: testArn})
+		pod.Spec.ServiceAccountName = serviceAccount
+		if podIdentity {
+			pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{Name: podIdentityVolume})
+		}
+		return pod
+	}
+	testCases := []struct {
+		name   string
+		pod    *corev1.Pod
+		policy string
+		allow  bool
+		warn   bool
+		audit  map[string]string
+	}{
+		{"irsa", podWith("irsa", false), credentialsDeny, true, false,
+			map[string]string{"credentials": "irsa", "role-arn": "arn:aws:iam::123456789012:role/app"}},
+		{"pod identity", podWith("", true), credentialsDeny, true, false,
+			map[string]string{"credentials": "pod-identity"}},
+		{"no credentials, warn", podWith("", false), credentialsWarn, true, true,
+			map[string]string{"credentials": "none"}},
+		{"no credentials, deny", podWith("", false), credentialsDeny, false, false,
+			map[string]string{"credentials": "none"}},
+		{"missing service account", podWith("missing", false), credentialsDeny, false, false,
+			map[string]string{"credentials": "none"}},
+		{"no secrets", secretPod(nil), credentialsDeny, true, false, nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			credentialsPolicy = tc.policy
+			resp := validatePods(podReview(t, tc.pod))
+			if resp.Allowed != tc.allow {
+				t.Errorf("Allowed = %v, want %v: %#v", resp.Allowed, tc.allow, resp.Result)
+			}
+			if (len(resp.Warnings) > 0) != tc.warn {
+				t.Errorf("unexpected warnings %q", resp.Warnings)
+			}
+			if !reflect.DeepEqual(resp.AuditAnnotations, tc.audit) {
+				t.Errorf("got audit annotations %v, want %v", resp.AuditAnnotations, tc.audit)
+			}
+		})
+	}
+}
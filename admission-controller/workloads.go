@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// annotationInjected is set on the pod templates that mutateWorkloads injected
+// the secrets into. Pods created from them carry it, which tells mutatePods
+// that they already have their secrets.
+const annotationInjected = "secrets.k8s.aws/injected"
+
+// workloadResources are the resources whose pod template mutateWorkloads
+// injects secrets into.
+var workloadResources = map[metav1.GroupVersionResource]func() runtime.Object{
+	{Group: "apps", Version: "v1", Resource: "deployments"}:  func() runtime.Object { return &appsv1.Deployment{} },
+	{Group: "apps", Version: "v1", Resource: "statefulsets"}: func() runtime.Object { return &appsv1.StatefulSet{} },
+	{Group: "apps", Version: "v1", Resource: "daemonsets"}:   func() runtime.Object { return &appsv1.DaemonSet{} },
+	{Group: "batch", Version: "v1", Resource: "jobs"}:        func() runtime.Object { return &batchv1.Job{} },
+	{Group: "batch", Version: "v1", Resource: "cronjobs"}:    func() runtime.Object { return &batchv1.CronJob{} },
+}
+
+// podTemplate returns the pod template of a workload object.
+func podTemplate(obj runtime.Object) *corev1.PodTemplateSpec {
+	switch o := obj.(type) {
+	case *appsv1.Deployment:
+		return &o.Spec.Template
+	case *appsv1.StatefulSet:
+		return &o.Spec.Template
+	case *appsv1.DaemonSet:
+		return &o.Spec.Template
+	case *batchv1.Job:
+		return &o.Spec.Template
+	case *batchv1.CronJob:
+		return &o.Spec.JobTemplate.Spec.Template
+	}
+	return nil
+}
+
+// injectedInTemplate reports whether pod was created from a pod template that
+// the secrets were injected into.
+func injectedInTemplate(pod *corev1.Pod) bool {
+	_, ok := pod.ObjectMeta.Annotations[annotationInjected]
+	return ok
+}
+
+// mutateWorkloads injects the secrets requested by the pod template of a
+// workload into the template, exactly as mutatePods would into its pods, and
+// marks the template with annotationInjected. The injection is then part of
+// the workload, where GitOps tools and kubectl diff show it, rather than
+// happening behind their back when pods are created.
+func mutateWorkloads(ar v1.AdmissionReview) *v1.AdmissionResponse {
+	log.debug("mutating workloads", fields{fieldUID: ar.Request.UID})
+	newObject, ok := workloadResources[ar.Request.Resource]
+	if !ok {
+		err := fmt.Errorf("unexpected resource %s", ar.Request.Resource)
+		log.error("unexpected resource", fields{fieldUID: ar.Request.UID, fieldError: err})
+		return toV1AdmissionResponse(err)
+	}
+	obj := newObject()
+	deserializer := codecs.UniversalDeserializer()
+	if _, _, err := deserializer.Decode(ar.Request.Object.Raw, nil, obj); err != nil {
+		log.error("unable to decode workload", fields{fieldUID: ar.Request.UID, fieldError: err})
+		return toV1AdmissionResponse(err)
+	}
+
+	template := podTemplate(obj)
+	pod := &corev1.Pod{ObjectMeta: *template.ObjectMeta.DeepCopy(), Spec: *template.Spec.DeepCopy()}
+	pod.Namespace = ar.Request.Namespace
+	reviewResponse := &v1.AdmissionResponse{Allowed: true}
+	if len(secretRequests(pod.ObjectMeta.Annotations)) == 0 || injectedInTemplate(pod) || skipInjection(ar, pod) {
+		return reviewResponse
+	}
+	mutated := pod.DeepCopy()
+	defaults := applyNamespaceDefaults(mutated, ar.Request.Namespace)
+	reviewResponse.Warnings = annotationWarnings(mutated)
+	if err := injectSecrets(mutated); err != nil {
+		return mutationFailed(ar, err)
+	}
+	if apiequality.Semantic.DeepEqual(pod.Spec, mutated.Spec) {
+		return reviewResponse
+	}
+
+	updated := obj.DeepCopyObject()
+	updatedTemplate := podTemplate(updated)
+	updatedTemplate.Spec = mutated.Spec
+	updatedTemplate.ObjectMeta.Annotations = mutated.ObjectMeta.Annotations
+	updatedTemplate.ObjectMeta.Annotations[annotationInjected] = "true"
+	patch, err := createPatch(obj, updated)
+	if err != nil {
+		log.error("unable to create patch", fields{fieldUID: ar.Request.UID, fieldError: err})
+		return toV1AdmissionResponse(err)
+	}
+	reviewResponse.Patch = patch
+	pt := v1.PatchTypeJSONPatch
+	reviewResponse.PatchType = &pt
+	reviewResponse.AuditAnnotations = injectionAudit(pod, mutated, defaults)
+	log.info("patched workload", fields{
+		fieldUID:       ar.Request.UID,
+		fieldNamespace: ar.Request.Namespace,
+		"workload":     ar.Request.Resource.Resource + "/" + ar.Request.Name,
+		fieldSecretArn: secretArns(pod),
+		"patch_bytes":  len(patch),
+	})
+	return reviewResponse
+}
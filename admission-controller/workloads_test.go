@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	v1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func workloadReview(t *testing.T, obj runtime.Object, resource metav1.GroupVersionResource) v1.AdmissionReview {
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v1.AdmissionReview{
+		Request: &v1.AdmissionRequest{
+			UID:       "uid",
+			Namespace: "default",
+			Name:      "web",
+			Operation: v1.Create,
+			Resource:  resource,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	}
+}
+
+// admitWorkload runs obj through mutateWorkloads and decodes the patched
+// object into out.
+func admitWorkload(t *testing.T, obj runtime.Object, resource metav1.GroupVersionResource, out runtime.Object) *v1.AdmissionResponse {
+	t.Helper()
+	review := workloadReview(t, obj, resource)
+	resp := mutateWorkloads(review)
+	if !resp.Allowed {
+		t.Fatalf("workload was not allowed: %#v", resp.Result)
+	}
+	patched := review.Request.Object.Raw
+	if resp.Patch != nil {
+		patch, err := jsonpatch.DecodePatch(resp.Patch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if patched, err = patch.Apply(patched); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := json.Unmarshal(patched, out); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func templateOf(pod *corev1.Pod) corev1.PodTemplateSpec {
+	return corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Annotations: pod.Annotations}, Spec: pod.Spec}
+}
+
+func TestMutateWorkloads(t *testing.T) {
+	sidecarImage = "test-image"
+	annotations := map[string]string{annotationSecretArn: testArn, annotationContainers: "app"}
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec:       appsv1.DeploymentSpec{Template: templateOf(secretPod(annotations))},
+	}
+	deploymentResource := metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	out := &appsv1.Deployment{}
+	resp := admitWorkload(t, deployment, deploymentResource, out)
+	if resp.Patch == nil || resp.AuditAnnotations[auditSecretArns] != testArn {
+		t.Fatalf("expected the deployment to be patched, got %#v", resp)
+	}
+
+	// The template gets what a pod would.
+	want := admit(t, mutatePods, secretPod(annotations))
+	template := out.Spec.Template
+	if template.Annotations[annotationInjected] != "true" {
+		t.Errorf("template is not marked, annotations %v", template.Annotations)
+	}
+	if len(template.Spec.InitContainers) != 1 || template.Spec.InitContainers[0].Name != initContainerName ||
+		len(template.Spec.Containers[0].VolumeMounts) != len(want.Spec.Containers[0].VolumeMounts) {
+		t.Errorf("unexpected template %#v", template.Spec)
+	}
+
+	// Pods created from it are left alone and valid.
+	pod := &corev1.Pod{ObjectMeta: template.ObjectMeta, Spec: template.Spec}
+	pod.Name, pod.Namespace = "web-1", "default"
+	if resp := mutatePods(podReview(t, pod)); !resp.Allowed || resp.Patch != nil {
+		t.Errorf("expected the pod to be left alone, got %#v", resp)
+	}
+	if resp := validatePods(podReview(t, pod)); !resp.Allowed {
+		t.Errorf("pod was rejected: %s", resp.Result.Message)
+	}
+
+	// Updates of the injected deployment change nothing.
+	if resp := admitWorkload(t, out, deploymentResource, &appsv1.Deployment{}); resp.Patch != nil {
+		t.Errorf("injected deployment was patched again: %s", resp.Patch)
+	}
+}
+
+func TestMutateWorkloadsCronJob(t *testing.T) {
+	sidecarImage = "test-image"
+	cronJob := &batchv1.CronJob{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec: batchv1.CronJobSpec{
+			Schedule: "@daily",
+			JobTemplate: batchv1.JobTemplateSpec{Spec: batchv1.JobSpec{
+				Template: templateOf(secretPod(map[string]string{annotationSecretArn: testArn})),
+			}},
+		},
+	}
+	out := &batchv1.CronJob{}
+	admitWorkload(t, cronJob, metav1.GroupVersionResource{Group: "batch", Version: "v1", Resource: "cronjobs"}, out)
+	if c := out.Spec.JobTemplate.Spec.Template.Spec.InitContainers; len(c) != 1 || c[0].Name != initContainerName {
+		t.Errorf("unexpected init containers %#v", c)
+	}
+	if out.Spec.Schedule != "@daily" {
+		t.Errorf("schedule was modified: %q", out.Spec.Schedule)
+	}
+}
+
+func TestMutateWorkloadsSkips(t *testing.T) {
+	deployment := &appsv1.Deployment{Spec: appsv1.DeploymentSpec{Template: templateOf(secretPod(nil))}}
+	if resp := admitWorkload(t, deployment, metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}, &appsv1.Deployment{}); resp.Patch != nil {
+		t.Errorf("deployment without secrets was patched: %s", resp.Patch)
+	}
+	resp := mutateWorkloads(workloadReview(t, deployment, metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "replicasets"}))
+	if resp.Allowed {
+		t.Error("expected an unsupported resource to fail")
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+)
+
+// batchSize is the maximum number of secret IDs accepted by a single
+// BatchGetSecretValue call.
+const batchSize = 20
+
+// secret is a secret value retrieved from Secrets Manager.
+type secret struct {
+	arn       string
+	name      string
+	versionID string
+	value     []byte
+}
+
+// fetchError is returned when one or more secrets could not be retrieved.
+type fetchError struct {
+	id      string
+	code    string
+	message string
+}
+
+func (e *fetchError) Error() string {
+	return fmt.Sprintf("%s: %s: %s", e.id, e.code, e.message)
+}
+
+type fetcher struct {
+	svc secretsmanageriface.SecretsManagerAPI
+}
+
+// get retrieves the AWSCURRENT version of a single secret.
+func (f *fetcher) get(id string) (*secret, error) {
+	result, err := f.svc.GetSecretValue(&secretsmanager.GetSecretValueInput{
+		SecretId:     aws.String(id),
+		VersionStage: aws.String("AWSCURRENT"),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			return nil, &fetchError{id: id, code: aerr.Code(), message: aerr.Message()}
+		}
+		return nil, err
+	}
+	value, err := secretValue(result.SecretString, result.SecretBinary)
+	if err != nil {
+		return nil, err
+	}
+	return &secret{
+		arn:       aws.StringValue(result.ARN),
+		name:      aws.StringValue(result.Name),
+		versionID: aws.StringValue(result.VersionId),
+		value:     value,
+	}, nil
+}
+
+// batchGet retrieves the AWSCURRENT version of every secret in ids with as
+// few BatchGetSecretValue calls as possible. Secrets that could not be
+// retrieved are logged and reported through the returned error; the secrets
+// that were retrieved are returned either way.
+func (f *fetcher) batchGet(ids []string) ([]*secret, error) {
+	var secrets []*secret
+	var failed []string
+	for start := 0; start < len(ids); start += batchSize {
+		end := start + batchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		input := &secretsmanager.BatchGetSecretValueInput{
+			SecretIdList: aws.StringSlice(ids[start:end]),
+		}
+		for {
+			out, err := f.svc.BatchGetSecretValue(input)
+			if err != nil {
+				return secrets, err
+			}
+			for _, e := range out.SecretValues {
+				value, err := secretValue(e.SecretString, e.SecretBinary)
+				if err != nil {
+					log.error("unable to decode binary secret", fields{fieldSecretArn: aws.StringValue(e.ARN), fieldError: err})
+					failed = append(failed, aws.StringValue(e.ARN))
+					continue
+				}
+				secrets = append(secrets, &secret{
+					arn:       aws.StringValue(e.ARN),
+					name:      aws.StringValue(e.Name),
+					versionID: aws.StringValue(e.VersionId),
+					value:     value,
+				})
+			}
+			for _, e := range out.Errors {
+				log.error("unable to retrieve secret", fields{
+					fieldSecretArn: aws.StringValue(e.SecretId),
+					fieldErrorCode: aws.StringValue(e.ErrorCode),
+					fieldError:     aws.StringValue(e.Message),
+				})
+				failed = append(failed, aws.StringValue(e.SecretId))
+			}
+			if out.NextToken == nil {
+				break
+			}
+			input.NextToken = out.NextToken
+		}
+	}
+	if len(failed) > 0 {
+		return secrets, fmt.Errorf("unable to retrieve %d secret(s): %s", len(failed), strings.Join(failed, ", "))
+	}
+	return secrets, nil
+}
+
+// list returns the ARNs of every secret whose name starts with namePrefix and
+// that carries all of the given tags. The Secrets Manager tag filters match
+// keys and values independently, so the exact key/value pairs are checked
+// here.
+func (f *fetcher) list(namePrefix string, tags map[string]string) ([]string, error) {
+	var filters []*secretsmanager.Filter
+	if namePrefix != "" {
+		filters = append(filters, &secretsmanager.Filter{
+			Key:    aws.String(secretsmanager.FilterNameStringTypeName),
+			Values: aws.StringSlice([]string{namePrefix}),
+		})
+	}
+	for k, v := range tags {
+		filters = append(filters,
+			&secretsmanager.Filter{Key: aws.String(secretsmanager.FilterNameStringTypeTagKey), Values: aws.StringSlice([]string{k})},
+			&secretsmanager.Filter{Key: aws.String(secretsmanager.FilterNameStringTypeTagValue), Values: aws.StringSlice([]string{v})},
+		)
+	}
+	var arns []string
+	err := f.svc.ListSecretsPages(&secretsmanager.ListSecretsInput{Filters: filters}, func(out *secretsmanager.ListSecretsOutput, last bool) bool {
+		for _, e := range out.SecretList {
+			if strings.HasPrefix(aws.StringValue(e.Name), namePrefix) && hasTags(e.Tags, tags) {
+				arns = append(arns, aws.StringValue(e.ARN))
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(arns)
+	return arns, nil
+}
+
+func hasTags(tags []*secretsmanager.Tag, want map[string]string) bool {
+	for k, v := range want {
+		found := false
+		for _, t := range tags {
+			if aws.StringValue(t.Key) == k && aws.StringValue(t.Value) == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// secretValue returns the payload of a secret. Depending on whether the secret
+// is a string or binary, one of the fields will be populated.
+func secretValue(secretString *string, secretBinary []byte) ([]byte, error) {
+	if secretString != nil {
+		value := []byte(*secretString)
+		protect(value)
+		log.redact(value)
+		return value, nil
+	}
+	log.redact(secretBinary)
+	decoded := make([]byte, base64.StdEncoding.DecodedLen(len(secretBinary)))
+	protect(decoded)
+	n, err := base64.StdEncoding.Decode(decoded, secretBinary)
+	wipe(secretBinary)
+	if err != nil {
+		release(decoded)
+		return nil, fmt.Errorf("base64 decode error: %w", err)
+	}
+	log.redact(decoded[:n])
+	return decoded[:n], nil
+}
+
+// secretPath derives the file a secret is written to from its name, so that
+// a secret named prod/payments/db is written to <mount point>/prod/payments/db.
+func secretPath(name string) (string, error) {
+	clean := path.Clean("/" + name)
+	for _, elem := range strings.Split(name, "/") {
+		if elem == ".." {
+			return "", fmt.Errorf("secret name %q is not a valid path", name)
+		}
+	}
+	if clean == "/" {
+		return "", fmt.Errorf("secret name %q is not a valid path", name)
+	}
+	return clean, nil
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+)
+
+// fakeSecretsManager serves secrets from a map keyed by ARN and records the
+// calls it receives.
+type fakeSecretsManager struct {
+	secretsmanageriface.SecretsManagerAPI
+	secrets    map[string]*secretsmanager.SecretListEntry
+	values     map[string]string
+	versions   map[string]string
+	binary     map[string][]byte
+	batchCalls int
+	getCalls   int
+}
+
+func newFakeSecretsManager() *fakeSecretsManager {
+	return &fakeSecretsManager{
+		secrets:  map[string]*secretsmanager.SecretListEntry{},
+		values:   map[string]string{},
+		versions: map[string]string{},
+		binary:   map[string][]byte{},
+	}
+}
+
+func (f *fakeSecretsManager) add(name, value string, tags map[string]string) string {
+	arn := "arn:aws:secretsmanager:us-east-1:123456789012:secret:" + name + "-AbCdEf"
+	entry := &secretsmanager.SecretListEntry{ARN: aws.String(arn), Name: aws.String(name)}
+	for k, v := range tags {
+		entry.Tags = append(entry.Tags, &secretsmanager.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+	f.secrets[arn] = entry
+	f.values[arn] = value
+	return arn
+}
+
+func (f *fakeSecretsManager) lookup(id string) (string, bool) {
+	for arn, e := range f.secrets {
+		if id == arn || id == aws.StringValue(e.Name) {
+			return arn, true
+		}
+	}
+	return "", false
+}
+
+func (f *fakeSecretsManager) version(arn string) string {
+	if v, ok := f.versions[arn]; ok {
+		return v
+	}
+	return "v1"
+}
+
+func (f *fakeSecretsManager) GetSecretValue(in *secretsmanager.GetSecretValueInput) (*secretsmanager.GetSecretValueOutput, error) {
+	f.getCalls++
+	arn, ok := f.lookup(aws.StringValue(in.SecretId))
+	if !ok {
+		return nil, fmt.Errorf("not found")
+	}
+	out := &secretsmanager.GetSecretValueOutput{
+		ARN:       aws.String(arn),
+		Name:      f.secrets[arn].Name,
+		VersionId: aws.String(f.version(arn)),
+	}
+	if b, ok := f.binary[arn]; ok {
+		out.SecretBinary = b
+	} else {
+		out.SecretString = aws.String(f.values[arn])
+	}
+	return out, nil
+}
+
+func (f *fakeSecretsManager) BatchGetSecretValue(in *secretsmanager.BatchGetSecretValueInput) (*secretsmanager.BatchGetSecretValueOutput, error) {
+	f.batchCalls++
+	if len(in.SecretIdList) > batchSize {
+		return nil, fmt.Errorf("too many secret IDs: %d", len(in.SecretIdList))
+	}
+	out := &secretsmanager.BatchGetSecretValueOutput{}
+	for _, id := range aws.StringValueSlice(in.SecretIdList) {
+		arn, ok := f.lookup(id)
+		if !ok {
+			out.Errors = append(out.Errors, &secretsmanager.APIErrorType{
+				SecretId:  aws.String(id),
+				ErrorCode: aws.String(secretsmanager.ErrCodeResourceNotFoundException),
+				Message:   aws.String("Secrets Manager can't find the specified secret."),
+			})
+			continue
+		}
+		out.SecretValues = append(out.SecretValues, &secretsmanager.SecretValueEntry{
+			ARN:          aws.String(arn),
+			Name:         f.secrets[arn].Name,
+			SecretString: aws.String(f.values[arn]),
+			VersionId:    aws.String(f.version(arn)),
+		})
+	}
+	return out, nil
+}
+
+func (f *fakeSecretsManager) DescribeSecret(in *secretsmanager.DescribeSecretInput) (*secretsmanager.DescribeSecretOutput, error) {
+	arn, ok := f.lookup(aws.StringValue(in.SecretId))
+	if !ok {
+		return nil, fmt.Errorf("not found")
+	}
+	e := f.secrets[arn]
+	return &secretsmanager.DescribeSecretOutput{
+		ARN:              e.ARN,
+		Name:             e.Name,
+		Description:      e.Description,
+		RotationEnabled:  e.RotationEnabled,
+		LastRotatedDate:  e.LastRotatedDate,
+		NextRotationDate: e.NextRotationDate,
+		Tags:             e.Tags,
+		VersionIdsToStages: map[string][]*string{
+			f.version(arn): aws.StringSlice([]string{"AWSCURRENT"}),
+			"previous":     aws.StringSlice([]string{"AWSPREVIOUS"}),
+		},
+	}, nil
+}
+
+func (f *fakeSecretsManager) ListSecretsPages(in *secretsmanager.ListSecretsInput, fn func(*secretsmanager.ListSecretsOutput, bool) bool) error {
+	out := &secretsmanager.ListSecretsOutput{}
+	for _, e := range f.secrets {
+		out.SecretList = append(out.SecretList, e)
+	}
+	fn(out, true)
+	return nil
+}
+
+func withMountPoint(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := mountPoint
+	mountPoint = dir
+	t.Cleanup(func() {
+		mountPoint = old
+		os.RemoveAll(dir)
+	})
+	return dir
+}
+
+func TestBatchGetSplitsRequests(t *testing.T) {
+	sm := newFakeSecretsManager()
+	var ids []string
+	for i := 0; i < 45; i++ {
+		ids = append(ids, sm.add(fmt.Sprintf("app/secret-%02d", i), "value", nil))
+	}
+	secrets, err := (&fetcher{svc: sm}).batchGet(ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secrets) != 45 {
+		t.Errorf("got %d secrets, want 45", len(secrets))
+	}
+	if sm.batchCalls != 3 {
+		t.Errorf("got %d BatchGetSecretValue calls, want 3", sm.batchCalls)
+	}
+}
+
+func TestBatchGetReportsMissingSecrets(t *testing.T) {
+	sm := newFakeSecretsManager()
+	found := sm.add("app/found", "value", nil)
+	secrets, err := (&fetcher{svc: sm}).batchGet([]string{found, "app/missing"})
+	if err == nil {
+		t.Fatal("expected an error for the missing secret")
+	}
+	if len(secrets) != 1 || secrets[0].arn != found {
+		t.Errorf("expected the secret that was found to be returned, got %v", secrets)
+	}
+}
+
+func TestListMatchesExactTags(t *testing.T) {
+	sm := newFakeSecretsManager()
+	payments := sm.add("prod/payments/db", "value", map[string]string{"app": "payments", "env": "prod"})
+	sm.add("prod/orders/db", "value", map[string]string{"app": "orders", "env": "payments"})
+	sm.add("dev/payments/db", "value", map[string]string{"app": "payments"})
+
+	arns, err := (&fetcher{svc: sm}).list("prod/", map[string]string{"app": "payments"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(arns, []string{payments}) {
+		t.Errorf("got %v, want %v", arns, []string{payments})
+	}
+}
+
+func TestSecretPath(t *testing.T) {
+	for name, want := range map[string]string{
+		"db":               "/db",
+		"prod/payments/db": "/prod/payments/db",
+		"/leading/slash":   "/leading/slash",
+		"a//b":             "/a/b",
+		"../escape":        "",
+		"a/../../escape":   "",
+		"":                 "",
+	} {
+		got, err := secretPath(name)
+		if want == "" {
+			if err == nil {
+				t.Errorf("secretPath(%q) = %q, want error", name, got)
+			}
+			continue
+		}
+		if err != nil || got != want {
+			t.Errorf("secretPath(%q) = %q, %v, want %q", name, got, err, want)
+		}
+	}
+}
+
+func TestRunWritesSecretsByName(t *testing.T) {
+	dir := withMountPoint(t)
+	sm := newFakeSecretsManager()
+	primary := sm.add("app/primary", "primary-value", nil)
+	sm.add("app/payments/db", "db-value", map[string]string{"app": "payments"})
+	sm.add("app/payments/api-key", "api-value", map[string]string{"app": "payments"})
+
+	cfg := &config{secretArn: primary, secretFilename: "/creds/primary", tags: map[string]string{"app": "payments"}}
+	if err := newRunner(&fetcher{svc: sm}, cfg).run(); err != nil {
+		t.Fatal(err)
+	}
+	if sm.batchCalls != 1 || sm.getCalls != 0 {
+		t.Errorf("got %d batch and %d single calls, want 1 and 0", sm.batchCalls, sm.getCalls)
+	}
+	for file, want := range map[string]string{
+		"creds/primary":        "primary-value",
+		"app/payments/db":      "db-value",
+		"app/payments/api-key": "api-value",
+	} {
+		got, err := ioutil.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			t.Errorf("reading %s: %v", file, err)
+			continue
+		}
+		if string(got) != want {
+			t.Errorf("%s = %q, want %q", file, got, want)
+		}
+	}
+}
+
+func TestRunSingleSecretUsesGetSecretValue(t *testing.T) {
+	dir := withMountPoint(t)
+	sm := newFakeSecretsManager()
+	arn := sm.add("app/only", "only-value", nil)
+
+	if err := newRunner(&fetcher{svc: sm}, &config{secretArn: arn}).run(); err != nil {
+		t.Fatal(err)
+	}
+	if sm.batchCalls != 0 || sm.getCalls != 1 {
+		t.Errorf("got %d batch and %d single calls, want 0 and 1", sm.batchCalls, sm.getCalls)
+	}
+	if got, _ := ioutil.ReadFile(filepath.Join(dir, "secret")); string(got) != "only-value" {
+		t.Errorf("secret = %q, want %q", got, "only-value")
+	}
+}
+
+func TestRunWritesSecretFiles(t *testing.T) {
+	dir := withMountPoint(t)
+	sm := newFakeSecretsManager()
+	db := sm.add("app/db", "db-value", nil)
+	sm.add("app/api", "api-value", nil)
+
+	cfg := &config{files: map[string]string{
+		"/db/secret":        db,
+		"/replica/password": db,
+		"/api/key":          "app/api",
+	}}
+	if err := newRunner(&fetcher{svc: sm}, cfg).run(); err != nil {
+		t.Fatal(err)
+	}
+	for file, want := range map[string]string{
+		"db/secret":        "db-value",
+		"replica/password": "db-value",
+		"api/key":          "api-value",
+	} {
+		got, err := ioutil.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			t.Errorf("reading %s: %v", file, err)
+			continue
+		}
+		if string(got) != want {
+			t.Errorf("%s = %q, want %q", file, got, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "app")); !os.IsNotExist(err) {
+		t.Errorf("secrets mapped in SECRET_FILES were also written by name: %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// health reports the state of a refreshing fetcher to kubelet probes.
+type health struct {
+	mu       sync.Mutex
+	interval time.Duration
+	// ready is set once every secret was written successfully.
+	ready bool
+	// lastRun is when the last run finished, successfully or not.
+	lastRun time.Time
+}
+
+// record records the outcome of a run. It is a no-op on a nil health.
+func (h *health) record(err error, now time.Time) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastRun = now
+	if err == nil {
+		h.ready = true
+	}
+}
+
+// handler serves /readyz, which succeeds once the secrets have been written,
+// and /healthz, which fails when the refresh loop has stopped running. A run
+// that fails leaves the previous secrets in place, so it affects neither.
+func (h *health) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+		h.mu.Lock()
+		ready := h.ready
+		h.mu.Unlock()
+		if !ready {
+			http.Error(w, "secrets have not been written yet", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		h.mu.Lock()
+		lastRun := h.lastRun
+		h.mu.Unlock()
+		if !lastRun.IsZero() && time.Since(lastRun) > 3*h.interval {
+			http.Error(w, "secrets have not been refreshed since "+lastRun.UTC().Format(time.RFC3339), http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	return mux
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Field names shared by every log line written by the fetcher. The admission
+// controller and the secret operator use the same names so that logs from all
+// three binaries can be joined on them.
+const (
+	fieldPod       = "pod"
+	fieldNamespace = "namespace"
+	fieldSecretArn = "secret_arn"
+	fieldVersionID = "version_id"
+	fieldErrorCode = "error_code"
+	fieldError     = "error"
+)
+
+const redacted = "[REDACTED]"
+
+// fields holds the structured context attached to a single log line.
+type fields map[string]interface{}
+
+// logger writes one JSON object per line. The message and every string or
+// error field are passed through the redactor before the line is encoded, so
+// secret material that was registered with redact never reaches the output,
+// even when it is embedded in an error message returned by the SDK. Redacting
+// the fields rather than the encoded line leaves the keys and punctuation of
+// the JSON intact.
+//
+// The logger only keeps SHA-256 digests of registered secrets, and rolling
+// hashes of them that select the windows worth hashing, so it does not hold a
+// copy of secret material that would outlive the buffers wiped by the
+// fetcher.
+type logger struct {
+	mu   sync.Mutex
+	out  io.Writer
+	base fields
+	// lengths holds the lengths of registered secrets, longest first.
+	lengths []int
+	// rolling holds the rolling hashes of registered secrets, keyed by
+	// length, and digests their SHA-256 digests.
+	rolling map[int]map[uint64]bool
+	digests map[[sha256.Size]byte]bool
+}
+
+// minRedactLength is the length of the shortest value registered for
+// redaction. Shorter values, such as "1" or "true" in a JSON secret, would
+// match ordinary words and numbers of every log line.
+const minRedactLength = 8
+
+// rollBase is the base of the polynomial rolling hash.
+const rollBase = 1099511628211
+
+var log = newLogger(os.Stderr)
+
+func newLogger(out io.Writer) *logger {
+	return &logger{
+		out: out,
+		base: fields{
+			fieldPod:       os.Getenv("POD_NAME"),
+			fieldNamespace: os.Getenv("POD_NAMESPACE"),
+		},
+	}
+}
+
+// redact registers a secret payload. Any later log field containing the
+// payload, or a string value nested in it when the payload is a JSON
+// document, has the occurrence replaced with [REDACTED]. Values shorter than
+// minRedactLength are not registered.
+func (l *logger) redact(secret []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.add(secret)
+	var doc interface{}
+	if json.Unmarshal(secret, &doc) == nil {
+		l.addNested(doc)
+	}
+}
+
+func (l *logger) addNested(doc interface{}) {
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		for _, e := range v {
+			l.addNested(e)
+		}
+	case []interface{}:
+		for _, e := range v {
+			l.addNested(e)
+		}
+	case string:
+		b := []byte(v)
+		l.add(b)
+		wipe(b)
+	}
+}
+
+func (l *logger) add(value []byte) {
+	n := len(value)
+	if n < minRedactLength {
+		return
+	}
+	if l.rolling == nil {
+		l.rolling = map[int]map[uint64]bool{}
+		l.digests = map[[sha256.Size]byte]bool{}
+	}
+	if l.rolling[n] == nil {
+		l.rolling[n] = map[uint64]bool{}
+		l.lengths = append(l.lengths, n)
+		sort.Sort(sort.Reverse(sort.IntSlice(l.lengths)))
+	}
+	l.rolling[n][rollingHash(value)] = true
+	l.digests[sha256.Sum256(value)] = true
+}
+
+func rollingHash(b []byte) uint64 {
+	var h uint64
+	for _, c := range b {
+		h = h*rollBase + uint64(c)
+	}
+	return h
+}
+
+// scrub replaces every registered secret in s with [REDACTED]. Longer
+// secrets are matched first, so a JSON document is redacted as a whole rather
+// than value by value. Only the windows whose rolling hash matches a secret
+// are hashed with SHA-256.
+func (l *logger) scrub(s string) string {
+	line := []byte(s)
+	for _, n := range l.lengths {
+		if n > len(line) {
+			continue
+		}
+		hashes := l.rolling[n]
+		pow := uint64(1)
+		for i := 1; i < n; i++ {
+			pow *= rollBase
+		}
+		var out []byte
+		last := 0
+		h := rollingHash(line[:n])
+		for i := 0; i+n <= len(line); {
+			if hashes[h] && l.digests[sha256.Sum256(line[i:i+n])] {
+				out = append(out, line[last:i]...)
+				out = append(out, redacted...)
+				i += n
+				last = i
+				if i+n <= len(line) {
+					h = rollingHash(line[i : i+n])
+				}
+				continue
+			}
+			if i+n < len(line) {
+				h = (h-uint64(line[i])*pow)*rollBase + uint64(line[i+n])
+			}
+			i++
+		}
+		if out != nil {
+			line = append(out, line[last:]...)
+		}
+	}
+	return string(line)
+}
+
+func (l *logger) info(msg string, f fields) {
+	l.write("info", msg, f)
+}
+
+func (l *logger) error(msg string, f fields) {
+	l.write("error", msg, f)
+}
+
+func (l *logger) write(level, msg string, f fields) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry := fields{}
+	for k, v := range l.base {
+		if v != "" {
+			entry[k] = v
+		}
+	}
+	for k, v := range f {
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		if s, ok := v.(string); ok {
+			v = l.scrub(s)
+		}
+		entry[k] = v
+	}
+	entry["level"] = level
+	entry["msg"] = l.scrub(msg)
+	entry["ts"] = time.Now().UTC().Format(time.RFC3339Nano)
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line, _ = json.Marshal(fields{"level": "error", "msg": "unable to encode log entry"})
+	}
+	l.out.Write(append(line, '\n'))
+}
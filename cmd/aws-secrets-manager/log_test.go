@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLoggerWritesJSON(t *testing.T) {
+	var buf bytes.Buffer
+	l := newLogger(&buf)
+	l.base = fields{fieldPod: "web-0", fieldNamespace: "default"}
+	l.info("secret written", fields{fieldSecretArn: "arn:aws:secretsmanager:us-east-1:123456789012:secret:db", fieldVersionID: "v1"})
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("log line is not JSON: %v: %s", err, buf.String())
+	}
+	for k, want := range map[string]string{
+		"level":        "info",
+		"msg":          "secret written",
+		fieldPod:       "web-0",
+		fieldNamespace: "default",
+		fieldVersionID: "v1",
+	} {
+		if entry[k] != want {
+			t.Errorf("%s = %v, want %q", k, entry[k], want)
+		}
+	}
+}
+
+func TestLoggerRedactsSecrets(t *testing.T) {
+	secrets := []string{
+		"hunter2-plain-text",
+		`{"username":"admin","password":"p\"ss\\w0rd"}`,
+		"line one\nline two",
+	}
+	var buf bytes.Buffer
+	l := newLogger(&buf)
+	for _, s := range secrets {
+		l.redact([]byte(s))
+	}
+	for _, s := range secrets {
+		l.error("unable to write secret", fields{fieldError: errors.New("bad value " + s)})
+		l.info(s, fields{"value": s})
+	}
+	l.error("unable to parse", fields{fieldError: errors.New(`invalid character near p"ss\w0rd`)})
+
+	out := buf.String()
+	for _, leak := range []string{"hunter2-plain-text", "p\\\"ss\\\\w0rd", `p"ss\w0rd`, "line one", "admin"} {
+		if strings.Contains(out, leak) {
+			t.Errorf("log output contains secret material %q:\n%s", leak, out)
+		}
+	}
+	if !strings.Contains(out, redacted) {
+		t.Errorf("expected redaction marker in output:\n%s", out)
+	}
+}
+
+func TestLoggerIgnoresShortValues(t *testing.T) {
+	var buf bytes.Buffer
+	l := newLogger(&buf)
+	l.base = fields{}
+	l.redact([]byte(`{"port":"1","enabled":"true","user":"a","password":"correct-horse"}`))
+	l.info("secret written", fields{fieldSecretArn: "arn:aws:secretsmanager:us-east-1:123456789012:secret:db", "bytes": 1})
+	l.error("unable to connect", fields{fieldError: errors.New("login failed with correct-horse")})
+
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line is not JSON: %v: %s", err, line)
+		}
+		if _, ok := entry["level"]; !ok {
+			t.Errorf("log line lost its keys: %s", line)
+		}
+	}
+	out := buf.String()
+	if !strings.Contains(out, `"secret written"`) || !strings.Contains(out, ":secret:db") {
+		t.Errorf("short values were redacted from ordinary text:\n%s", out)
+	}
+	if strings.Contains(out, "correct-horse") || !strings.Contains(out, "login failed with "+redacted) {
+		t.Errorf("expected the password to be redacted:\n%s", out)
+	}
+}
+
+func TestLoggerScrub(t *testing.T) {
+	l := newLogger(nil)
+	l.redact([]byte("0123456789"))
+	l.redact([]byte("abcdefgh"))
+	for in, want := range map[string]string{
+		"":                           "",
+		"short":                      "short",
+		"0123456789":                 redacted,
+		"x0123456789abcdefghy":       "x" + redacted + redacted + "y",
+		"01234567890123456789":       redacted + redacted,
+		"abcdefg abcdefgh abcdefghi": "abcdefg " + redacted + " " + redacted + "i",
+	} {
+		if got := l.scrub(in); got != want {
+			t.Errorf("scrub(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -1,104 +1,283 @@
 package main
 
 import (
-	"encoding/base64"
+	"encoding/json"
 	"fmt"
-	"log"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/arn"
-	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/secretsmanager"
 )
 
+// mountPoint is the directory of the shared in-memory volume.
+var mountPoint = "/tmp"
+
+// config is read from the environment of the init container. SECRET_ARN and
+// SECRET_FILENAME are set by the admission controller; the remaining
+// variables select additional secrets that are retrieved in batches.
+type config struct {
+	// secretArn is written to secretFilename.
+	secretArn      string
+	secretFilename string
+	// secretIDs are the ARNs or names listed in SECRET_ARNS.
+	secretIDs []string
+	// files is read from SECRET_FILES, a JSON object that maps a path below
+	// the mount point to the ARN or name of the secret written there.
+	files map[string]string
+	// namePrefix and tags select every secret whose name starts with
+	// SECRET_NAME_PREFIX and that carries all tags in SECRET_TAG_FILTERS.
+	namePrefix string
+	tags       map[string]string
+	region     string
+	// refreshInterval is read from REFRESH_INTERVAL. When it is set the
+	// fetcher keeps running and refreshes the secrets at that interval.
+	refreshInterval time.Duration
+	// cleanup is read from SECRET_CLEANUP_ON_EXIT. When it is set the files
+	// written in refresh mode are removed when the fetcher is terminated.
+	cleanup bool
+	// validation maps a secret ARN or name to the rules it has to pass
+	// before it is written.
+	validation map[string]*rules
+	// metadataFormat is read from SECRET_METADATA, either json or files.
+	// When it is set the metadata fields selected in
+	// SECRET_METADATA_FIELDS are written next to every secret.
+	metadataFormat string
+	metadataFields map[string]bool
+	// healthAddr is read from HEALTH_ADDR. When it is set in refresh mode
+	// the fetcher serves /readyz and /healthz on that address.
+	healthAddr string
+}
+
+func configFromEnv() (*config, error) {
+	cfg := &config{
+		secretArn:      os.Getenv("SECRET_ARN"),
+		secretFilename: os.Getenv("SECRET_FILENAME"),
+		secretIDs:      splitList(os.Getenv("SECRET_ARNS")),
+		namePrefix:     os.Getenv("SECRET_NAME_PREFIX"),
+		tags:           map[string]string{},
+	}
+	for _, pair := range splitList(os.Getenv("SECRET_TAG_FILTERS")) {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("tag filter %q is not of the form key=value", pair)
+		}
+		cfg.tags[kv[0]] = kv[1]
+	}
+	if v := os.Getenv("SECRET_FILES"); v != "" {
+		files := map[string]string{}
+		if err := json.Unmarshal([]byte(v), &files); err != nil {
+			return nil, fmt.Errorf("SECRET_FILES is not valid JSON: %w", err)
+		}
+		cfg.files = map[string]string{}
+		for p, id := range files {
+			clean, err := secretPath(p)
+			if err != nil {
+				return nil, err
+			}
+			if id == "" {
+				return nil, fmt.Errorf("no secret for %s in SECRET_FILES", p)
+			}
+			cfg.files[clean] = id
+		}
+	}
+	if v := os.Getenv("REFRESH_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("REFRESH_INTERVAL %q is not a positive duration", v)
+		}
+		cfg.refreshInterval = d
+	}
+	cfg.cleanup = os.Getenv("SECRET_CLEANUP_ON_EXIT") == "true"
+	cfg.healthAddr = os.Getenv("HEALTH_ADDR")
+	validation, err := parseRules(os.Getenv("SECRET_VALIDATION"))
+	if err != nil {
+		return nil, err
+	}
+	cfg.validation = validation
+	cfg.metadataFormat = os.Getenv("SECRET_METADATA")
+	if cfg.metadataFormat != "" && cfg.metadataFormat != metadataJSON && cfg.metadataFormat != metadataFiles {
+		return nil, fmt.Errorf("SECRET_METADATA must be %s or %s", metadataJSON, metadataFiles)
+	}
+	if cfg.metadataFields, err = parseMetadataFields(os.Getenv("SECRET_METADATA_FIELDS")); err != nil {
+		return nil, err
+	}
+	lockMemory = os.Getenv("SECRET_MLOCK") == "true"
+	if cfg.secretArn == "" && len(cfg.secretIDs) == 0 && len(cfg.files) == 0 && !cfg.filtered() {
+		return nil, fmt.Errorf("one of SECRET_ARN, SECRET_ARNS, SECRET_FILES, SECRET_NAME_PREFIX or SECRET_TAG_FILTERS must be set")
+	}
+	if cfg.secretArn != "" && !arn.IsARN(cfg.secretArn) {
+		return nil, fmt.Errorf("not a valid ARN: %s", cfg.secretArn)
+	}
+	// Secrets can only be retrieved in batches from a single region, which is
+	// taken from the ARNs when there are any and from the AWS_REGION set by
+	// IRSA otherwise.
+	for _, id := range append([]string{cfg.secretArn}, cfg.ids()...) {
+		if !arn.IsARN(id) {
+			continue
+		}
+		arnobj, _ := arn.Parse(id)
+		if cfg.region != "" && arnobj.Region != cfg.region {
+			return nil, fmt.Errorf("secrets must be in a single region, found %s and %s", cfg.region, arnobj.Region)
+		}
+		cfg.region = arnobj.Region
+	}
+	return cfg, nil
+}
+
+// ids returns the ARNs and names in SECRET_ARNS and SECRET_FILES.
+func (c *config) ids() []string {
+	ids := append([]string(nil), c.secretIDs...)
+	paths := make([]string, 0, len(c.files))
+	for p := range c.files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		ids = append(ids, c.files[p])
+	}
+	return dedupe(ids)
+}
+
+// destinations returns the names, relative to the mount point, that s is
+// written to: SECRET_FILENAME for the secret in SECRET_ARN, the paths
+// SECRET_FILES maps to it, and otherwise a path derived from its name.
+func (c *config) destinations(s *secret) ([]string, error) {
+	var names []string
+	if s.matches(c.secretArn) {
+		names = append(names, c.secretFilename)
+	}
+	for p, id := range c.files {
+		if s.matches(id) {
+			names = append(names, p)
+		}
+	}
+	if len(names) == 0 {
+		p, err := secretPath(s.name)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, p)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (c *config) filtered() bool {
+	return c.namePrefix != "" || len(c.tags) > 0
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
 func main() {
-	secretArn := os.Getenv("SECRET_ARN")
-	secretFilename := os.Getenv("SECRET_FILENAME")
-	var AWSRegion string
-
-	if arn.IsARN(secretArn) {
-		arnobj, _ := arn.Parse(secretArn)
-		AWSRegion = arnobj.Region
-	} else {
-		log.Println("Not a valid ARN")
+	cfg, err := configFromEnv()
+	if err != nil {
+		log.error("invalid configuration", fields{fieldError: err})
 		os.Exit(1)
 	}
 
 	sess, err := session.NewSession()
 	if err != nil {
-		log.Panic(err)
+		log.error("unable to create AWS session", fields{fieldError: err})
+		os.Exit(1)
 	}
-	svc := secretsmanager.New(sess, &aws.Config{
-		Region: aws.String(AWSRegion),
-	})
-
-	input := &secretsmanager.GetSecretValueInput{
-		SecretId:     aws.String(secretArn),
-		VersionStage: aws.String("AWSCURRENT"),
+	awsConfig := &aws.Config{}
+	if cfg.region != "" {
+		awsConfig.Region = aws.String(cfg.region)
 	}
-
-	result, err := svc.GetSecretValue(input)
-	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			case secretsmanager.ErrCodeResourceNotFoundException:
-				fmt.Println(secretsmanager.ErrCodeResourceNotFoundException, aerr.Error())
-			case secretsmanager.ErrCodeInvalidParameterException:
-				fmt.Println(secretsmanager.ErrCodeInvalidParameterException, aerr.Error())
-			case secretsmanager.ErrCodeInvalidRequestException:
-				fmt.Println(secretsmanager.ErrCodeInvalidRequestException, aerr.Error())
-			case secretsmanager.ErrCodeDecryptionFailure:
-				fmt.Println(secretsmanager.ErrCodeDecryptionFailure, aerr.Error())
-			case secretsmanager.ErrCodeInternalServiceError:
-				fmt.Println(secretsmanager.ErrCodeInternalServiceError, aerr.Error())
-			default:
-				fmt.Println(aerr.Error())
+	r := newRunner(&fetcher{svc: secretsmanager.New(sess, awsConfig)}, cfg)
+	if cfg.refreshInterval != 0 && cfg.healthAddr != "" {
+		// The server is started before the first run, so a startup probe
+		// can wait for the secrets to be written.
+		r.health = &health{interval: cfg.refreshInterval}
+		go func() {
+			if err := http.ListenAndServe(cfg.healthAddr, r.health.handler()); err != nil {
+				log.error("unable to serve health checks", fields{fieldError: err})
 			}
-		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			log.Println(err.Error())
-		}
-		return
+		}()
 	}
-	// Decrypts secret using the associated KMS CMK.
-	// Depending on whether the secret is a string or binary, one of these fields will be populated.
-	var secretString, decodedBinarySecret string
-	if result.SecretString != nil {
-		secretString = *result.SecretString
-		writeOutput(secretString, secretFilename)
-	} else {
-		decodedBinarySecretBytes := make([]byte, base64.StdEncoding.DecodedLen(len(result.SecretBinary)))
-		len, err := base64.StdEncoding.Decode(decodedBinarySecretBytes, result.SecretBinary)
+
+	// The handler is registered before the first run, so that a signal
+	// received while it retrieves the secrets does not kill the fetcher
+	// before the secret buffers are released. In refresh mode the pending
+	// signal then stops the refresh loop right away and the files are
+	// cleaned up.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+	err = r.run()
+	if cfg.refreshInterval == 0 {
 		if err != nil {
-			log.Println("Base64 Decode Error:", err)
-			return
+			os.Exit(1)
 		}
-		decodedBinarySecret = string(decodedBinarySecretBytes[:len])
-		writeOutput(decodedBinarySecret, secretFilename)
+		return
+	}
+
+	r.refresh(cfg.refreshInterval, signals)
+	if cfg.cleanup {
+		r.removeFiles()
 	}
 }
-func writeOutput(output string, name string) error {
-	mountPoint := "/tmp"
+
+// outputPath returns the file below the mount point that name refers to.
+func outputPath(name string) string {
 	dir, file := filepath.Split(name)
 	if file == "" {
 		file = "secret"
 	}
-	err := os.MkdirAll(mountPoint + dir, os.ModePerm)
+	return filepath.Join(mountPoint+dir, file)
+}
+
+// writeOutput writes output to the file that name refers to. The file is
+// replaced atomically, so an application reading it while the secret is being
+// refreshed sees either the old or the new version.
+func writeOutput(output []byte, name string) error {
+	return writeFile(outputPath(name), output)
+}
+
+// writeFile atomically replaces the file at path with output.
+func writeFile(path string, output []byte) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("not a valid file path")
+	}
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
 	if err != nil {
 		return fmt.Errorf("error creating directory, %w", err)
 	}
-	if filepath.IsAbs(filepath.Join(mountPoint + dir, file)) {
-		f, err := os.Create(filepath.Join(mountPoint + dir, file))
-		defer f.Close()
-		if err != nil {
-			return fmt.Errorf("error creating file, %w", err)
-		}
-		f.WriteString(output)
-		return nil
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return fmt.Errorf("error creating file, %w", err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(output)
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
 	}
-	return fmt.Errorf("not a valid file path")
-}
\ No newline at end of file
+	if err != nil {
+		return fmt.Errorf("error writing file, %w", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("error writing file, %w", err)
+	}
+	return nil
+}
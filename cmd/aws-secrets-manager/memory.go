@@ -0,0 +1,38 @@
+package main
+
+// Secret payloads are kept in byte slices, never in Go strings, so that they
+// can be overwritten as soon as they have been written to the volume. The SDK
+// still returns SecretString as a string, which is converted immediately and
+// left for the garbage collector; this limits, but cannot remove, the copies
+// of a secret held by the process.
+
+// lockMemory controls whether secret buffers are locked into memory with
+// mlock(2) so they are never written to swap. It is set from SECRET_MLOCK.
+var lockMemory bool
+
+// wipe overwrites b with zeros.
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// protect locks the memory backing b when lockMemory is set. A failure to lock
+// is logged but not fatal, since it usually means the container lacks
+// CAP_IPC_LOCK or a large enough RLIMIT_MEMLOCK.
+func protect(b []byte) {
+	if !lockMemory || len(b) == 0 {
+		return
+	}
+	if err := mlock(b); err != nil {
+		log.error("unable to lock secret in memory", fields{fieldError: err})
+	}
+}
+
+// release wipes b and unlocks its memory.
+func release(b []byte) {
+	wipe(b)
+	if lockMemory && len(b) > 0 {
+		munlock(b)
+	}
+}
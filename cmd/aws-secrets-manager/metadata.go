@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+)
+
+// Formats of SECRET_METADATA.
+const (
+	// metadataJSON writes the metadata of a secret to <secret>.metadata.json.
+	metadataJSON = "json"
+	// metadataFiles writes every metadata field to its own file in the
+	// <secret>.metadata directory, with tags in <secret>.metadata/tags.
+	metadataFiles = "files"
+)
+
+// Metadata fields that can be selected with SECRET_METADATA_FIELDS.
+const (
+	metadataRotation      = "rotation"
+	metadataVersionStages = "versionStages"
+	metadataTags          = "tags"
+	metadataDescription   = "description"
+)
+
+var allMetadataFields = []string{metadataRotation, metadataVersionStages, metadataTags, metadataDescription}
+
+// metadata is the information returned by DescribeSecret that is exposed to
+// applications. Fields that were not selected are left empty.
+type metadata struct {
+	ARN              string              `json:"arn"`
+	Name             string              `json:"name"`
+	Description      string              `json:"description,omitempty"`
+	RotationEnabled  *bool               `json:"rotationEnabled,omitempty"`
+	LastRotatedDate  *time.Time          `json:"lastRotatedDate,omitempty"`
+	LastChangedDate  *time.Time          `json:"lastChangedDate,omitempty"`
+	NextRotationDate *time.Time          `json:"nextRotationDate,omitempty"`
+	VersionStages    map[string][]string `json:"versionStages,omitempty"`
+	Tags             map[string]string   `json:"tags,omitempty"`
+}
+
+// parseMetadataFields parses SECRET_METADATA_FIELDS, a comma separated list
+// of fields. All fields are selected when the list is empty.
+func parseMetadataFields(s string) (map[string]bool, error) {
+	selected := map[string]bool{}
+	list := splitList(s)
+	if len(list) == 0 {
+		list = allMetadataFields
+	}
+	for _, f := range list {
+		known := false
+		for _, k := range allMetadataFields {
+			known = known || f == k
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown metadata field %q, expected one of %s", f, strings.Join(allMetadataFields, ", "))
+		}
+		selected[f] = true
+	}
+	return selected, nil
+}
+
+// describe returns the selected metadata of a secret.
+func (f *fetcher) describe(id string, selected map[string]bool) (*metadata, error) {
+	out, err := f.svc.DescribeSecret(&secretsmanager.DescribeSecretInput{SecretId: aws.String(id)})
+	if err != nil {
+		return nil, err
+	}
+	m := &metadata{ARN: aws.StringValue(out.ARN), Name: aws.StringValue(out.Name)}
+	if selected[metadataDescription] {
+		m.Description = aws.StringValue(out.Description)
+	}
+	if selected[metadataRotation] {
+		m.RotationEnabled = aws.Bool(aws.BoolValue(out.RotationEnabled))
+		m.LastRotatedDate = out.LastRotatedDate
+		m.LastChangedDate = out.LastChangedDate
+		m.NextRotationDate = out.NextRotationDate
+	}
+	if selected[metadataVersionStages] {
+		m.VersionStages = map[string][]string{}
+		for v, stages := range out.VersionIdsToStages {
+			m.VersionStages[v] = aws.StringValueSlice(stages)
+		}
+	}
+	if selected[metadataTags] {
+		m.Tags = map[string]string{}
+		for _, t := range out.Tags {
+			m.Tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+		}
+	}
+	return m, nil
+}
+
+// writeMetadata writes m next to the secret file at path and returns the file
+// or directory it was written to.
+func writeMetadata(format string, m *metadata, path, versionID string) (string, error) {
+	if format == metadataJSON {
+		out, err := json.MarshalIndent(m, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		return path + ".metadata.json", writeFile(path+".metadata.json", out)
+	}
+
+	dir := path + ".metadata"
+	files := map[string]string{}
+	if m.Description != "" {
+		files["description"] = m.Description
+	}
+	if m.RotationEnabled != nil {
+		files["rotation-enabled"] = strconv.FormatBool(*m.RotationEnabled)
+	}
+	for name, t := range map[string]*time.Time{
+		"last-rotated-date":  m.LastRotatedDate,
+		"last-changed-date":  m.LastChangedDate,
+		"next-rotation-date": m.NextRotationDate,
+	} {
+		if t != nil {
+			files[name] = t.UTC().Format(time.RFC3339)
+		}
+	}
+	if m.VersionStages != nil {
+		// Only the stages of the version that was written are useful to
+		// an application reading the secret next to this file.
+		stages := append([]string(nil), m.VersionStages[versionID]...)
+		sort.Strings(stages)
+		files["version-stages"] = strings.Join(stages, "\n")
+	}
+	for k, v := range m.Tags {
+		if strings.ContainsAny(k, `/\`) || k == "." || k == ".." {
+			log.error("tag key is not a valid file name, skipping", fields{fieldSecretArn: m.ARN, "tag": k})
+			continue
+		}
+		files[filepath.Join("tags", k)] = v
+	}
+
+	for name, content := range files {
+		if err := writeFile(filepath.Join(dir, name), []byte(content)); err != nil {
+			return dir, err
+		}
+	}
+	// Remove files left over from a previous run, e.g. for a tag that was
+	// removed from the secret.
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		if _, ok := files[rel]; !ok {
+			return os.Remove(p)
+		}
+		return nil
+	})
+	return dir, err
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+)
+
+func addRotatedSecret(sm *fakeSecretsManager) string {
+	arn := sm.add("app/db", "value", map[string]string{"endpoint": "db.internal:5432"})
+	e := sm.secrets[arn]
+	e.Description = aws.String("payments database")
+	e.RotationEnabled = aws.Bool(true)
+	e.LastRotatedDate = aws.Time(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	e.NextRotationDate = aws.Time(time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC))
+	return arn
+}
+
+func TestMetadataJSON(t *testing.T) {
+	dir := withMountPoint(t)
+	sm := newFakeSecretsManager()
+	arn := addRotatedSecret(sm)
+	selected, err := parseMetadataFields("rotation,tags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config{secretArn: arn, secretFilename: "/db", metadataFormat: metadataJSON, metadataFields: selected}
+	if err := newRunner(&fetcher{svc: sm}, cfg).run(); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := ioutil.ReadFile(filepath.Join(dir, "db.metadata.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m metadata
+	if err := json.Unmarshal(raw, &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.ARN != arn || m.Tags["endpoint"] != "db.internal:5432" || !aws.BoolValue(m.RotationEnabled) {
+		t.Errorf("unexpected metadata: %s", raw)
+	}
+	if m.NextRotationDate == nil || !m.NextRotationDate.Equal(time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected next rotation date: %s", raw)
+	}
+	if m.Description != "" || m.VersionStages != nil {
+		t.Errorf("fields that were not selected were written: %s", raw)
+	}
+}
+
+func TestMetadataFiles(t *testing.T) {
+	dir := withMountPoint(t)
+	sm := newFakeSecretsManager()
+	arn := addRotatedSecret(sm)
+	selected, _ := parseMetadataFields("")
+	cfg := &config{secretArn: arn, secretFilename: "/db", metadataFormat: metadataFiles, metadataFields: selected}
+	r := newRunner(&fetcher{svc: sm}, cfg)
+	if err := r.run(); err != nil {
+		t.Fatal(err)
+	}
+	for file, want := range map[string]string{
+		"db.metadata/description":        "payments database",
+		"db.metadata/rotation-enabled":   "true",
+		"db.metadata/last-rotated-date":  "2024-01-01T00:00:00Z",
+		"db.metadata/next-rotation-date": "2024-02-01T00:00:00Z",
+		"db.metadata/version-stages":     "AWSCURRENT",
+		"db.metadata/tags/endpoint":      "db.internal:5432",
+	} {
+		got, err := ioutil.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			t.Errorf("reading %s: %v", file, err)
+			continue
+		}
+		if string(got) != want {
+			t.Errorf("%s = %q, want %q", file, got, want)
+		}
+	}
+
+	// A tag removed from the secret disappears on the next run.
+	sm.secrets[arn].Tags = []*secretsmanager.Tag{{Key: aws.String("team"), Value: aws.String("payments")}}
+	if err := r.run(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "db.metadata/tags/endpoint")); !os.IsNotExist(err) {
+		t.Errorf("expected stale tag file to be removed, got %v", err)
+	}
+	if got, _ := ioutil.ReadFile(filepath.Join(dir, "db.metadata/tags/team")); string(got) != "payments" {
+		t.Errorf("tags/team = %q, want %q", got, "payments")
+	}
+
+	r.removeFiles()
+	if _, err := os.Stat(filepath.Join(dir, "db.metadata")); !os.IsNotExist(err) {
+		t.Errorf("expected metadata to be removed, got %v", err)
+	}
+}
+
+func TestParseMetadataFieldsRejectsUnknownFields(t *testing.T) {
+	if _, err := parseMetadataFields("tags,kmsKeyId"); err == nil {
+		t.Error("expected an error for an unknown field")
+	}
+}
+
+// describeDenied fails every DescribeSecret call, as when the role lacks the
+// secretsmanager:DescribeSecret permission.
+type describeDenied struct {
+	*fakeSecretsManager
+}
+
+func (describeDenied) DescribeSecret(*secretsmanager.DescribeSecretInput) (*secretsmanager.DescribeSecretOutput, error) {
+	return nil, awserr.New("AccessDeniedException", "not authorized to perform secretsmanager:DescribeSecret", nil)
+}
+
+func TestMetadataFailureDoesNotFailRun(t *testing.T) {
+	dir := withMountPoint(t)
+	sm := newFakeSecretsManager()
+	db := sm.add("app/db", "db-value", nil)
+	api := sm.add("app/api", "api-value", nil)
+	selected, _ := parseMetadataFields("")
+	cfg := &config{secretIDs: []string{db, api}, metadataFormat: metadataJSON, metadataFields: selected}
+	if err := newRunner(&fetcher{svc: describeDenied{sm}}, cfg).run(); err != nil {
+		t.Fatalf("run failed on a metadata error: %v", err)
+	}
+	for file, want := range map[string]string{"app/db": "db-value", "app/api": "api-value"} {
+		if got, err := ioutil.ReadFile(filepath.Join(dir, file)); err != nil || string(got) != want {
+			t.Errorf("%s = %q, %v, want %q", file, got, err, want)
+		}
+	}
+}
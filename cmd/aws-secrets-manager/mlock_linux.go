@@ -0,0 +1,11 @@
+package main
+
+import "syscall"
+
+func mlock(b []byte) error {
+	return syscall.Mlock(b)
+}
+
+func munlock(b []byte) error {
+	return syscall.Munlock(b)
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+func mlock(b []byte) error {
+	return errors.New("mlock is only supported on linux")
+}
+
+func munlock(b []byte) error {
+	return nil
+}
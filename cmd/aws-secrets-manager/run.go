@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// runner retrieves the configured secrets and writes them below the mount
+// point, either once or at a fixed interval.
+type runner struct {
+	f   *fetcher
+	cfg *config
+	// versions maps every file that was written to the version of the secret
+	// it holds. Secret values themselves are not kept between runs.
+	versions map[string]string
+	// metadata holds the metadata files and directories that were written.
+	metadata map[string]bool
+	// health records the outcome of every run when HEALTH_ADDR is set.
+	health *health
+}
+
+func newRunner(f *fetcher, cfg *config) *runner {
+	return &runner{f: f, cfg: cfg, versions: map[string]string{}, metadata: map[string]bool{}}
+}
+
+// run retrieves every configured secret and writes it below the mount point.
+// A single secret is retrieved with GetSecretValue; several secrets are
+// retrieved with BatchGetSecretValue. Secret buffers are wiped before run
+// returns. Failures are logged before returning.
+func (r *runner) run() (err error) {
+	defer func() { r.health.record(err, time.Now()) }()
+
+	ids := r.cfg.ids()
+	if r.cfg.filtered() {
+		listed, err := r.f.list(r.cfg.namePrefix, r.cfg.tags)
+		if err != nil {
+			log.error("unable to list secrets", fields{fieldError: err, fieldErrorCode: errorCode(err)})
+			return err
+		}
+		ids = append(ids, listed...)
+	}
+	if r.cfg.secretArn != "" {
+		ids = append([]string{r.cfg.secretArn}, ids...)
+	}
+	ids = dedupe(ids)
+
+	var secrets []*secret
+	defer func() {
+		for _, s := range secrets {
+			release(s.value)
+		}
+	}()
+	var fetchErr error
+	if len(ids) == 1 {
+		s, err := r.f.get(ids[0])
+		if err != nil {
+			log.error("unable to retrieve secret", fields{fieldSecretArn: ids[0], fieldError: err, fieldErrorCode: errorCode(err)})
+			return err
+		}
+		secrets = append(secrets, s)
+	} else if len(ids) > 1 {
+		// Secrets that were retrieved are still written when others failed,
+		// but the failure is reported once they are.
+		secrets, fetchErr = r.f.batchGet(ids)
+		if fetchErr != nil {
+			log.error("unable to retrieve secrets", fields{fieldError: fetchErr, fieldErrorCode: errorCode(fetchErr)})
+		}
+	} else {
+		log.info("no secrets matched the configured filters", nil)
+	}
+
+	// Every secret is validated before any of them is written, so a bad
+	// rotation leaves all files, including those of valid secrets, as they
+	// were.
+	now := time.Now()
+	for _, s := range secrets {
+		if rules := r.cfg.rulesFor(s); rules != nil {
+			if err := rules.validate(s.value, now); err != nil {
+				log.error("secret failed validation, nothing was written", fields{fieldSecretArn: s.arn, fieldVersionID: s.versionID, fieldError: err})
+				return err
+			}
+		}
+	}
+
+	// A secret that cannot be written does not keep the others from being
+	// written; the failures are reported once they all were.
+	var failed []string
+	for _, s := range secrets {
+		names, err := r.cfg.destinations(s)
+		if err != nil {
+			log.error("unable to write secret", fields{fieldSecretArn: s.arn, fieldError: err})
+			failed = append(failed, s.arn)
+			continue
+		}
+		for _, name := range names {
+			if err := r.write(s, name); err != nil {
+				failed = append(failed, s.arn)
+				break
+			}
+		}
+	}
+	if len(failed) > 0 {
+		writeErr := fmt.Errorf("unable to write %d secret(s): %s", len(failed), strings.Join(failed, ", "))
+		if fetchErr != nil {
+			return fmt.Errorf("%v; %v", fetchErr, writeErr)
+		}
+		return writeErr
+	}
+	return fetchErr
+}
+
+// write writes s to name unless the file already holds the same version,
+// followed by its metadata when that is enabled. Metadata is optional, so
+// failing to describe the secret or write its metadata is logged but does not
+// fail the write.
+func (r *runner) write(s *secret, name string) error {
+	path := outputPath(name)
+	if v, ok := r.versions[path]; !ok || v != s.versionID {
+		if err := writeOutput(s.value, name); err != nil {
+			log.error("unable to write secret", fields{fieldSecretArn: s.arn, fieldVersionID: s.versionID, fieldError: err})
+			return err
+		}
+		r.versions[path] = s.versionID
+		log.info("secret written", fields{fieldSecretArn: s.arn, fieldVersionID: s.versionID})
+	}
+	if r.cfg.metadataFormat != "" {
+		r.writeMetadata(s, path)
+	}
+	return nil
+}
+
+// writeMetadata describes s and writes its metadata next to path. Tags and
+// rotation dates can change without a new version, so metadata is written on
+// every run. Failures are logged.
+func (r *runner) writeMetadata(s *secret, path string) {
+	m, err := r.f.describe(s.arn, r.cfg.metadataFields)
+	if err != nil {
+		log.error("unable to describe secret", fields{fieldSecretArn: s.arn, fieldError: err, fieldErrorCode: errorCode(err)})
+		return
+	}
+	written, err := writeMetadata(r.cfg.metadataFormat, m, path, s.versionID)
+	if written != "" {
+		r.metadata[written] = true
+	}
+	if err != nil {
+		log.error("unable to write secret metadata", fields{fieldSecretArn: s.arn, fieldError: err})
+	}
+}
+
+// refresh runs r every interval until a signal is received on stop. Failed
+// runs are logged and leave the previously written files in place.
+func (r *runner) refresh(interval time.Duration, stop <-chan os.Signal) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case sig := <-stop:
+			log.info("stopping", fields{"signal": sig.String()})
+			return
+		case <-ticker.C:
+			r.run()
+		}
+	}
+}
+
+// removeFiles removes every file written by r from the volume.
+func (r *runner) removeFiles() {
+	for path := range r.versions {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.error("unable to remove secret", fields{fieldError: err})
+			continue
+		}
+		delete(r.versions, path)
+	}
+	for path := range r.metadata {
+		if err := os.RemoveAll(path); err != nil {
+			log.error("unable to remove secret metadata", fields{fieldError: err})
+			continue
+		}
+		delete(r.metadata, path)
+	}
+}
+
+// rulesFor returns the validation rules configured for s, if any.
+func (c *config) rulesFor(s *secret) *rules {
+	for id, rules := range c.validation {
+		if s.matches(id) {
+			return rules
+		}
+	}
+	return nil
+}
+
+// matches reports whether id, an ARN or a name, refers to s.
+func (s *secret) matches(id string) bool {
+	return id != "" && (id == s.arn || id == s.name)
+}
+
+func dedupe(ids []string) []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+func errorCode(err error) string {
+	if ferr, ok := err.(*fetchError); ok {
+		return ferr.code
+	}
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code()
+	}
+	return ""
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRunWipesSecretBuffers(t *testing.T) {
+	withMountPoint(t)
+	sm := newFakeSecretsManager()
+	arn := sm.add("app/binary", "", nil)
+	raw := []byte(base64.StdEncoding.EncodeToString([]byte("binary-value")))
+	sm.binary[arn] = raw
+
+	if err := newRunner(&fetcher{svc: sm}, &config{secretArn: arn}).run(); err != nil {
+		t.Fatal(err)
+	}
+	for i, b := range raw {
+		if b != 0 {
+			t.Fatalf("secret buffer not wiped at offset %d: %q", i, raw)
+		}
+	}
+}
+
+func TestRunSkipsUnchangedVersions(t *testing.T) {
+	dir := withMountPoint(t)
+	sm := newFakeSecretsManager()
+	arn := sm.add("app/rotating", "first", nil)
+	r := newRunner(&fetcher{svc: sm}, &config{secretArn: arn})
+	if err := r.run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new value under the same version is not written again.
+	sm.values[arn] = "unexpected"
+	if err := r.run(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadFile(filepath.Join(dir, "secret")); string(got) != "first" {
+		t.Errorf("secret = %q, want %q", got, "first")
+	}
+
+	sm.values[arn] = "second"
+	sm.versions[arn] = "v2"
+	if err := r.run(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadFile(filepath.Join(dir, "secret")); string(got) != "second" {
+		t.Errorf("secret = %q, want %q", got, "second")
+	}
+}
+
+func TestRefreshStopsAndRemovesFiles(t *testing.T) {
+	dir := withMountPoint(t)
+	sm := newFakeSecretsManager()
+	arn := sm.add("app/refreshed", "value", nil)
+	r := newRunner(&fetcher{svc: sm}, &config{secretArn: arn, secretFilename: "/app/refreshed"})
+	if err := r.run(); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	go func() {
+		r.refresh(time.Millisecond, stop)
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	stop <- syscall.SIGTERM
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("refresh did not stop on SIGTERM")
+	}
+	if sm.getCalls < 2 {
+		t.Errorf("got %d GetSecretValue calls, expected the secret to be refreshed", sm.getCalls)
+	}
+
+	r.removeFiles()
+	if _, err := os.Stat(filepath.Join(dir, "app/refreshed")); !os.IsNotExist(err) {
+		t.Errorf("expected secret file to be removed, got %v", err)
+	}
+}
+
+func TestWriteOutputLeavesNoTemporaryFiles(t *testing.T) {
+	dir := withMountPoint(t)
+	if err := writeOutput([]byte("value"), "/nested/secret"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ioutil.ReadDir(filepath.Join(dir, "nested"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "secret" {
+		t.Errorf("unexpected files in volume: %v", entries)
+	}
+	if mode := entries[0].Mode().Perm(); mode != 0644 {
+		t.Errorf("secret mode = %v, want 0644", mode)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	withMountPoint(t)
+	sm := newFakeSecretsManager()
+	arn := sm.add("app/db", "password", nil)
+	r := newRunner(&fetcher{svc: sm}, &config{secretArn: arn})
+	r.health = &health{interval: time.Minute}
+	h := r.health.handler()
+	status := func(path string) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code
+	}
+
+	if got := status("/readyz"); got != http.StatusServiceUnavailable {
+		t.Errorf("readyz before the first run = %d", got)
+	}
+	if got := status("/healthz"); got != http.StatusOK {
+		t.Errorf("healthz before the first run = %d", got)
+	}
+	if err := r.run(); err != nil {
+		t.Fatal(err)
+	}
+	if got := status("/readyz"); got != http.StatusOK {
+		t.Errorf("readyz after a run = %d", got)
+	}
+
+	// A failed refresh leaves the written secret in place.
+	delete(sm.secrets, arn)
+	if err := r.run(); err == nil {
+		t.Fatal("expected the run to fail")
+	}
+	if got := status("/readyz"); got != http.StatusOK {
+		t.Errorf("readyz after a failed run = %d", got)
+	}
+
+	r.health.lastRun = time.Now().Add(-time.Hour)
+	if got := status("/healthz"); got != http.StatusServiceUnavailable {
+		t.Errorf("healthz after the refresh loop stopped = %d", got)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// rules are the checks a secret has to pass before it is written. They are
+// read from SECRET_VALIDATION, a JSON object that maps a secret ARN or name
+// to its rules, for example
+//
+//	{"prod/db": {"jsonKeys": ["username", "password"], "minLength": 16}}
+//
+// Error messages never include the secret value.
+type rules struct {
+	// JSONKeys lists keys that must be present, and not empty, in the JSON
+	// object stored in the secret.
+	JSONKeys []string `json:"jsonKeys,omitempty"`
+	// JSONSchema is a JSON Schema the secret has to conform to.
+	JSONSchema json.RawMessage `json:"jsonSchema,omitempty"`
+	// Regex is a regular expression the secret has to match.
+	Regex string `json:"regex,omitempty"`
+	// MinLength and MaxLength bound the length of the secret in bytes.
+	MinLength int `json:"minLength,omitempty"`
+	MaxLength int `json:"maxLength,omitempty"`
+	// CertMinDays requires every PEM certificate in the secret to remain
+	// valid for at least that many days.
+	CertMinDays int `json:"certMinDays,omitempty"`
+
+	regex  *regexp.Regexp
+	schema *gojsonschema.Schema
+}
+
+// parseRules parses and compiles the rules in SECRET_VALIDATION.
+func parseRules(s string) (map[string]*rules, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var all map[string]*rules
+	if err := json.Unmarshal([]byte(s), &all); err != nil {
+		return nil, fmt.Errorf("SECRET_VALIDATION is not valid JSON: %w", err)
+	}
+	for id, r := range all {
+		if r == nil {
+			return nil, fmt.Errorf("no validation rules for %s", id)
+		}
+		if r.Regex != "" {
+			re, err := regexp.Compile(r.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("invalid regex for %s: %w", id, err)
+			}
+			r.regex = re
+		}
+		if len(r.JSONSchema) > 0 {
+			schema, err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(r.JSONSchema))
+			if err != nil {
+				return nil, fmt.Errorf("invalid JSON schema for %s: %w", id, err)
+			}
+			r.schema = schema
+		}
+		if r.MaxLength > 0 && r.MinLength > r.MaxLength {
+			return nil, fmt.Errorf("minLength is greater than maxLength for %s", id)
+		}
+	}
+	return all, nil
+}
+
+// validate checks value against r and returns an error describing the first
+// rule it breaks.
+func (r *rules) validate(value []byte, now time.Time) error {
+	if r.MinLength > 0 && len(value) < r.MinLength {
+		return fmt.Errorf("secret is shorter than %d bytes", r.MinLength)
+	}
+	if r.MaxLength > 0 && len(value) > r.MaxLength {
+		return fmt.Errorf("secret is longer than %d bytes", r.MaxLength)
+	}
+	if r.regex != nil && !r.regex.Match(value) {
+		return fmt.Errorf("secret does not match %q", r.Regex)
+	}
+	if len(r.JSONKeys) > 0 {
+		var doc map[string]interface{}
+		if err := json.Unmarshal(value, &doc); err != nil {
+			return fmt.Errorf("secret is not a JSON object")
+		}
+		for _, k := range r.JSONKeys {
+			if v, ok := doc[k]; !ok || v == nil || v == "" {
+				return fmt.Errorf("secret is missing JSON key %q", k)
+			}
+		}
+	}
+	if r.schema != nil {
+		result, err := r.schema.Validate(gojsonschema.NewBytesLoader(value))
+		if err != nil {
+			return fmt.Errorf("secret is not valid JSON")
+		}
+		if !result.Valid() {
+			// Only the location and type of each error are reported; the
+			// descriptions can quote the offending value.
+			var msg bytes.Buffer
+			for i, e := range result.Errors() {
+				if i > 0 {
+					msg.WriteString(", ")
+				}
+				fmt.Fprintf(&msg, "%s: %s", e.Field(), e.Type())
+			}
+			return fmt.Errorf("secret does not conform to the JSON schema: %s", msg.String())
+		}
+	}
+	if r.CertMinDays > 0 {
+		if err := checkCertificates(value, now.Add(time.Duration(r.CertMinDays)*24*time.Hour)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkCertificates requires value to contain at least one PEM certificate
+// and every certificate in it to be valid until deadline.
+func checkCertificates(value []byte, deadline time.Time) error {
+	found := false
+	for rest := value; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("secret contains an invalid certificate: %w", err)
+		}
+		if cert.NotAfter.Before(deadline) {
+			return fmt.Errorf("certificate %q expires at %s", cert.Subject.CommonName, cert.NotAfter.UTC().Format(time.RFC3339))
+		}
+		found = true
+	}
+	if !found {
+		return fmt.Errorf("secret does not contain a PEM certificate")
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testCertificate(t *testing.T, notAfter time.Time) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    notAfter.Add(-365 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	valid := testCertificate(t, now.Add(90*24*time.Hour))
+	expiring := testCertificate(t, now.Add(10*24*time.Hour))
+
+	testCases := []struct {
+		name  string
+		rules string
+		value string
+		ok    bool
+	}{
+		{"min length", `{"minLength": 8}`, "", false},
+		{"min length ok", `{"minLength": 8}`, "long enough", true},
+		{"max length", `{"maxLength": 4}`, "too long", false},
+		{"regex", `{"regex": "^[A-Za-z0-9]{12,}$"}`, "short", false},
+		{"regex ok", `{"regex": "^[A-Za-z0-9]{12,}$"}`, "abcdefghijkl", true},
+		{"json keys", `{"jsonKeys": ["username", "password"]}`, `{"username": "admin"}`, false},
+		{"json keys empty value", `{"jsonKeys": ["password"]}`, `{"password": ""}`, false},
+		{"json keys not json", `{"jsonKeys": ["password"]}`, `password`, false},
+		{"json keys ok", `{"jsonKeys": ["username", "password"]}`, `{"username": "admin", "password": "x"}`, true},
+		{"json schema", `{"jsonSchema": {"type": "object", "required": ["port"], "properties": {"port": {"type": "integer"}}}}`, `{"port": "5432"}`, false},
+		{"json schema ok", `{"jsonSchema": {"type": "object", "required": ["port"], "properties": {"port": {"type": "integer"}}}}`, `{"port": 5432}`, true},
+		{"certificate expiring", `{"certMinDays": 30}`, expiring, false},
+		{"certificate missing", `{"certMinDays": 30}`, "not a certificate", false},
+		{"certificate ok", `{"certMinDays": 30}`, valid, true},
+		{"certificate chain", `{"certMinDays": 30}`, valid + expiring, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			all, err := parseRules(`{"db": ` + tc.rules + `}`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = all["db"].validate([]byte(tc.value), now)
+			if tc.ok && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !tc.ok && err == nil {
+				t.Error("expected validation to fail")
+			}
+			if err != nil && tc.value != "" && strings.Contains(err.Error(), tc.value) {
+				t.Errorf("error message contains the secret value: %v", err)
+			}
+		})
+	}
+}
+
+func TestParseRulesRejectsInvalidRules(t *testing.T) {
+	for _, s := range []string{
+		`not json`,
+		`{"db": {"regex": "("}}`,
+		`{"db": {"jsonSchema": {"type": 5}}}`,
+		`{"db": {"minLength": 10, "maxLength": 5}}`,
+		`{"db": null}`,
+	} {
+		if _, err := parseRules(s); err == nil {
+			t.Errorf("parseRules(%s) succeeded, expected an error", s)
+		}
+	}
+}
+
+func TestRunKeepsPreviousVersionWhenValidationFails(t *testing.T) {
+	dir := withMountPoint(t)
+	sm := newFakeSecretsManager()
+	db := sm.add("app/db", `{"password": "first"}`, nil)
+	api := sm.add("app/api", "api-key", nil)
+	validation, err := parseRules(`{"app/db": {"jsonKeys": ["password"]}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newRunner(&fetcher{svc: sm}, &config{secretIDs: []string{db, api}, validation: validation})
+	if err := r.run(); err != nil {
+		t.Fatal(err)
+	}
+
+	sm.values[db] = `{"password": ""}`
+	sm.versions[db] = "v2"
+	sm.values[api] = "rotated-api-key"
+	sm.versions[api] = "v2"
+	if err := r.run(); err == nil {
+		t.Fatal("expected validation to fail")
+	}
+	for file, want := range map[string]string{
+		"app/db":  `{"password": "first"}`,
+		"app/api": "api-key",
+	} {
+		if got, _ := ioutil.ReadFile(filepath.Join(dir, file)); string(got) != want {
+			t.Errorf("%s = %q, want %q", file, got, want)
+		}
+	}
+}
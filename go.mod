@@ -3,6 +3,6 @@ module main
 go 1.13
 
 require (
-	github.com/aws/aws-sdk-go v1.30.27
-	golang.org/x/net v0.0.0-20200513185701-a91f0712d120 // indirect
+	github.com/aws/aws-sdk-go v1.55.5
+	github.com/xeipuuv/gojsonschema v1.2.0
 )
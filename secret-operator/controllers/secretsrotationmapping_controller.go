@@ -21,6 +21,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/go-logr/logr"
@@ -51,6 +52,7 @@ type SecretsRotationMappingReconciler struct {
 
 func (r *SecretsRotationMappingReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	ctx := context.Background()
+	log := r.Log.WithValues("namespace", req.Namespace, "secretsrotationmapping", req.Name)
 
 	var DeleteMessageBatchList []*sqs.DeleteMessageBatchRequestEntry
 	var SecretsRotationMapping awssecretsoperatorv1.SecretsRotationMapping
@@ -75,7 +77,7 @@ func (r *SecretsRotationMappingReconciler) Reconcile(req ctrl.Request) (ctrl.Res
 	})
 
 	if err != nil {
-		fmt.Println("Error", err)
+		log.Error(err, "unable to receive messages", "error_code", errorCode(err))
 		return ctrl.Result{RequeueAfter: time.Second * r.RequeueAfter}, nil
 	}
 
@@ -84,7 +86,7 @@ func (r *SecretsRotationMappingReconciler) Reconcile(req ctrl.Request) (ctrl.Res
 	for _, element := range message.Messages {
 		err := json.Unmarshal([]byte(*element.Body), &result)
 		if err != nil {
-			fmt.Println("Error", err)
+			log.Error(err, "unable to decode message", "message_id", aws.StringValue(element.MessageId))
 		}
 
 		detail := result["detail"].(map[string]interface{})
@@ -94,11 +96,11 @@ func (r *SecretsRotationMappingReconciler) Reconcile(req ctrl.Request) (ctrl.Res
 		if eventName == "PutSecretValue" {
 			requestParameters := detail["requestParameters"].(map[string]interface{})
 			secretID := requestParameters["secretId"]
-			fmt.Println("Secret ID rotated", secretID)
+			log.Info("secret rotated", "secret_arn", secretID)
 
 			//if the secretID in SQS message is not same as the secret in CRD, continue with next message
 			if secretID != SecretsRotationMapping.Spec.SecretID {
-				fmt.Println("continuing to next loop")
+				log.V(1).Info("secret not mapped, skipping", "secret_arn", secretID)
 				continue
 			}
 
@@ -110,10 +112,10 @@ func (r *SecretsRotationMappingReconciler) Reconcile(req ctrl.Request) (ctrl.Res
 
 			for _, deployment := range deploy.Items {
 				// Patch the Deployment with new label containing redeployed timestamp, to force redeploy
-				fmt.Println("Rotating deployment", deployment.ObjectMeta.Name)
+				log.Info("rotating deployment", "deployment", deployment.ObjectMeta.Name, "secret_arn", secretID)
 				patch := []byte(fmt.Sprintf(`{"spec":{"template":{"metadata":{"labels":{"aws-secrets-controller-redeloyed":"%v"}}}}}`, time.Now().Unix()))
 				if err := r.Patch(ctx, &deployment, client.RawPatch(types.StrategicMergePatchType, patch)); err != nil {
-					fmt.Println("Patch deployment err:", err)
+					log.Error(err, "unable to patch deployment", "deployment", deployment.ObjectMeta.Name)
 					return ctrl.Result{RequeueAfter: time.Second * r.RequeueAfter}, nil
 				}
 			}
@@ -125,10 +127,10 @@ func (r *SecretsRotationMappingReconciler) Reconcile(req ctrl.Request) (ctrl.Res
 
 			for _, DaemonSet := range DaemonSetList.Items {
 				// Patch the DaemonSet with new label containing redeployed timestamp, to force redeploy
-				fmt.Println("Rotating DaemonSet", DaemonSet.ObjectMeta.Name)
+				log.Info("rotating daemonset", "daemonset", DaemonSet.ObjectMeta.Name, "secret_arn", secretID)
 				patch := []byte(fmt.Sprintf(`{"spec":{"template":{"metadata":{"labels":{"aws-secrets-operator-redeloyed":"%v"}}}}}`, time.Now().Unix()))
 				if err := r.Patch(ctx, &DaemonSet, client.RawPatch(types.StrategicMergePatchType, patch)); err != nil {
-					fmt.Println("Patch DaemonSet err:", err)
+					log.Error(err, "unable to patch daemonset", "daemonset", DaemonSet.ObjectMeta.Name)
 					return ctrl.Result{RequeueAfter: time.Second * r.RequeueAfter}, nil
 				}
 			}
@@ -139,10 +141,10 @@ func (r *SecretsRotationMappingReconciler) Reconcile(req ctrl.Request) (ctrl.Res
 
 			for _, StatefulSet := range StatefulSetList.Items {
 				// Patch the StatefulSet with new label containing redeployed timestamp, to force redeploy
-				fmt.Println("Rotating StatefulSet", StatefulSet.ObjectMeta.Name)
+				log.Info("rotating statefulset", "statefulset", StatefulSet.ObjectMeta.Name, "secret_arn", secretID)
 				patch := []byte(fmt.Sprintf(`{"spec":{"template":{"metadata":{"labels":{"aws-secrets-operator-redeloyed":"%v"}}}}}`, time.Now().Unix()))
 				if err := r.Patch(ctx, &StatefulSet, client.RawPatch(types.StrategicMergePatchType, patch)); err != nil {
-					fmt.Println("Patch StatefulSet err:", err)
+					log.Error(err, "unable to patch statefulset", "statefulset", StatefulSet.ObjectMeta.Name)
 					return ctrl.Result{RequeueAfter: time.Second * r.RequeueAfter}, nil
 				}
 			}
@@ -158,14 +160,24 @@ func (r *SecretsRotationMappingReconciler) Reconcile(req ctrl.Request) (ctrl.Res
 		DeleteMessageBatchInput := &sqs.DeleteMessageBatchInput{Entries: DeleteMessageBatchList, QueueUrl: &r.QueueUrl}
 		DeleteMessageBatchOutput, err := svc.DeleteMessageBatch(DeleteMessageBatchInput)
 		if err != nil {
-			fmt.Println("DeleteMessageBatchList error:", err)
+			log.Error(err, "unable to delete messages", "error_code", errorCode(err))
+		} else {
+			log.V(1).Info("deleted messages", "successful", len(DeleteMessageBatchOutput.Successful), "failed", len(DeleteMessageBatchOutput.Failed))
 		}
-		fmt.Println("DeleteMessageBatchList output:", DeleteMessageBatchOutput)
 
 	}
 	return ctrl.Result{RequeueAfter: time.Second * r.RequeueAfter}, nil
 }
 
+// errorCode returns the AWS error code of err, or an empty string if err did
+// not come from the SDK.
+func errorCode(err error) string {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code()
+	}
+	return ""
+}
+
 func (r *SecretsRotationMappingReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&awssecretsoperatorv1.SecretsRotationMapping{}).